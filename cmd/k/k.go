@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
@@ -11,9 +12,13 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/niklasfasching/k/cli"
+	"github.com/niklasfasching/k/config"
 	"github.com/niklasfasching/k/server"
 	"github.com/niklasfasching/k/util"
 )
@@ -22,22 +27,26 @@ var api = cli.API{
 	"init":     {F: initConfig, Desc: "set up the provided config <dir>"},
 	"ls":       {F: ls, Desc: "list all apps"},
 	"deploy":   {F: deploy, Desc: "deploy  config & app", Complete: completeApps},
+	"canary":   {F: canary, Desc: "send <percent> of traffic to the last target of Split routes until the next deploy of the app", Complete: completeApps},
 	"start":    {F: systemctl, Desc: "systemctl start", Complete: completeApps},
 	"stop":     {F: systemctl, Desc: "systemctl stop", Complete: completeApps},
 	"reload":   {F: systemctl, Desc: "systemctl reload", Complete: completeApps},
 	"restart":  {F: systemctl, Desc: "systemctl restart", Complete: completeApps},
 	"status":   {F: systemctl, Desc: `systemctl status`, Complete: completeApps},
+	"certs":    {F: certs, Desc: "list route hostnames with certificate issuer, expiry and last renewal attempt (--check fails for expiring ones)"},
 	"logs":     {F: systemctl, Desc: "journalctl K=<app>", Complete: completeApps},
 	"tunnel":   {F: tunnel, Desc: "tunnel <address>:<remote_address>"},
 	"notify":   {F: notify, Desc: "send message to k.Vars.telegram $bot_id:$token:$chat_id"},
 	"encrypt":  {F: encrypt, Desc: "encrypt the provided <value>"},
 	"decrypt":  {F: decrypt, Desc: "decrypt the provided <value>"},
 	"sign":     {F: sign, Desc: "sign the provided <file>"},
+	"hash":     {F: hash, Desc: "hash a password for BasicAuth.Users (bcrypt or --argon2id)"},
 	"render":   {F: render, Desc: "render systemd config"},
 	"version":  {F: version},
 	"generate": {F: generate, Desc: "-"},
 	"receive":  {F: receive, Desc: "-"},
 	"serve":    {F: serve, Desc: "-"},
+	"health":   {F: health, Desc: "-"},
 }
 
 type Root string
@@ -105,6 +114,23 @@ func decrypt(cmd string, args struct{ CipherText string }) error {
 	return nil
 }
 
+func hash(cmd string, a struct{}, f struct{ Argon2id bool }) error {
+	pass, err := util.ReadPassword()
+	if err != nil {
+		return err
+	}
+	algorithm := "bcrypt"
+	if f.Argon2id {
+		algorithm = "argon2id"
+	}
+	s, err := server.HashPassword(string(pass), algorithm)
+	if err != nil {
+		return err
+	}
+	log.Println(s)
+	return nil
+}
+
 func sign(cmd string, args struct{ File, SigFile string }) error {
 	kbs, err := os.ReadFile(root.SignKeyFile())
 	if err != nil {
@@ -155,6 +181,47 @@ func deploy(cmd string,
 	return deployApp(sc, c, name)
 }
 
+func canary(cmd string, x struct{ App, Percent string }) error {
+	percent, err := strconv.Atoi(x.Percent)
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100: %q", x.Percent)
+	}
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	name, err := getAppName(c, x.App)
+	if err != nil {
+		return err
+	}
+	weights := [][]int{}
+	for _, r := range c.Apps[name].Routes {
+		if r.Split == nil {
+			continue
+		} else if len(r.Split.Weights) != 2 {
+			return fmt.Errorf("canary requires Split routes with 2 targets: %v", r.Patterns)
+		}
+		weights = append(weights, r.Split.Weights)
+	}
+	if len(weights) == 0 {
+		return fmt.Errorf("%s has no Split routes", name)
+	}
+	sc, err := util.SSH(c.User, c.Host)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	// the percentage is stored on the server so syncConfig does not reset it - deployApp does
+	f := config.CanaryFile(name)
+	script := fmt.Sprintf("set -x; mkdir -p %q && echo %d > %q && systemctl reload k-http.service", filepath.Dir(f), percent, f)
+	if _, err := util.SSHExec(sc, script, false); err != nil {
+		return err
+	}
+	log.Printf("%s: active weights [%d %d] differ from configured weights %v until the next deploy of %s",
+		name, 100-percent, percent, weights, name)
+	return nil
+}
+
 func systemctl(cmd string, x struct {
 	App string
 }) error {
@@ -184,6 +251,68 @@ func systemctl(cmd string, x struct {
 	return err
 }
 
+func certs(cmd string, a struct{}, f struct{ Check bool }) error {
+	if !root.IsClient() {
+		c, err := server.ReadConfig(filepath.Join(root.ConfigDir(), "k", "k-http.json"))
+		if err != nil {
+			return err
+		}
+		infos, err := c.CertInventory(context.Background())
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOSTNAME\tSOURCE\tISSUER\tEXPIRES\tLAST ATTEMPT")
+		for _, i := range infos {
+			expires, attempt := "-", "-"
+			if i.Source == "" {
+				i.Source = "-"
+			}
+			if i.Issuer == "" {
+				i.Issuer = "-"
+			}
+			if !i.NotAfter.IsZero() {
+				expires = fmt.Sprintf("%s (%dd)", i.NotAfter.Format("2006-01-02"), int(time.Until(i.NotAfter).Hours()/24))
+			}
+			if !i.LastAttempt.IsZero() {
+				attempt = i.LastAttempt.Format("2006-01-02 15:04")
+			}
+			if i.LastError != "" {
+				attempt += " failed: " + i.LastError
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", i.Hostname, i.Source, i.Issuer, expires, attempt)
+		}
+		if err := w.Flush(); err != nil || !f.Check {
+			return err
+		}
+		msgs, err := c.ExpiringCertificates(context.Background())
+		if err != nil {
+			return err
+		} else if len(msgs) != 0 {
+			return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+		}
+		return nil
+	}
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	sc, err := util.SSH(c.User, c.Host)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	if err := remoteInstallBinary(sc, serverBin); err != nil {
+		return err
+	}
+	check := ""
+	if f.Check {
+		check = " --check"
+	}
+	_, err = util.SSHExec(sc, fmt.Sprintf("%s certs%s", serverBin, check), false)
+	return err
+}
+
 func initConfig(cmd string, x struct{ Dir string }) error {
 	if _, err := os.Stat(filepath.Join(x.Dir, "k.yaml")); err != nil {
 		return fmt.Errorf("k config dir requires k.yaml: %w", err)
@@ -282,6 +411,20 @@ func serve(cmd string, x struct{ ConfigPath string }) error {
 	return server.Start(x.ConfigPath)
 }
 
+func health(cmd string, x struct{ Target string }, f struct {
+	Path    string
+	Status  int `cli:"::0"`
+	Timeout int `cli:"::60"`
+}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(f.Timeout)*time.Second)
+	defer cancel()
+	return server.WaitHealthy(ctx, x.Target, server.HealthCheck{
+		Path:     f.Path,
+		Status:   f.Status,
+		Interval: server.Duration(500 * time.Millisecond),
+	})
+}
+
 func tunnel(cmd string, x struct{ LocalAddress string }) error {
 	c, err := loadConfig()
 	if err != nil {
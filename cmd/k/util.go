@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"text/template"
 	"time"
 
@@ -107,36 +108,36 @@ func sendTelegramMessage(botId, token, chatId, text string) error {
 	return nil
 }
 
-func sync(sc *ssh.Client, srcDir, dstDir string) (int, error) {
+func sync(sc *ssh.Client, srcDir, dstDir string) (int, []string, error) {
 	s, err := sc.NewSession()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	defer s.Close()
 	r, err := s.StderrPipe()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	go func() { io.Copy(os.Stderr, r) }()
 	rw, err := s.StdinPipe()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	rr, err := s.StdoutPipe()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
-	g, n, cancel := errgroup.Group{}, 0, func() { s.Close() }
+	g, n, changed, cancel := errgroup.Group{}, 0, []string{}, func() { s.Close() }
 	g.Go(func() (err error) {
 		defer cancel()
-		n, err = util.NewPipe(rr, rw).Send(srcDir, dstDir)
+		n, changed, err = util.NewPipe(rr, rw).Send(srcDir, dstDir)
 		return err
 	})
 	g.Go(func() (err error) {
 		defer cancel()
 		return s.Run(fmt.Sprintf("%s receive", serverBin))
 	})
-	return n, g.Wait()
+	return n, changed, g.Wait()
 }
 
 func completeApps(args []string) []string {
@@ -165,10 +166,16 @@ func syncConfig(sc *ssh.Client, c *config.C) error {
 	defer func() { os.RemoveAll(dir) }()
 	if err := renderConfig(c, dir); err != nil {
 		return err
-	} else if n, err := sync(sc, dir, serverRoot.ConfigDir()); err != nil {
+	} else if n, changed, err := sync(sc, dir, serverRoot.ConfigDir()); err != nil {
 		return err
 	} else if n != 0 {
-		cmd := `set -x; systemctl daemon-reload && systemctl restart k-http.target`
+		cmd := fmt.Sprintf(`set -x; mkdir -p /etc/polkit-1/rules.d && ln -sf %q /etc/polkit-1/rules.d/50-k-http.rules
+          mkdir -p /etc/sysusers.d && ln -sf %q /etc/sysusers.d/k-http.conf && systemd-sysusers
+          systemctl daemon-reload && systemctl restart k-http.target`,
+			filepath.Join(serverRoot.ConfigDir(), "k", "k-http.rules"), filepath.Join(serverRoot.ConfigDir(), "k", "k-http.sysusers"))
+		if onlyRoutes := n == 1 && len(changed) == 1 && changed[0] == "k/k-http.json"; onlyRoutes {
+			cmd = `set -x; systemctl daemon-reload && systemctl reload-or-restart k-http.service`
+		}
 		_, err := util.SSHExec(sc, cmd, false)
 		return err
 	}
@@ -185,14 +192,38 @@ func deployApp(sc *ssh.Client, c *config.C, name string) error {
 			return err
 		}
 	}
-	if _, err := sync(sc, aDir, filepath.Join(string(serverRoot), name)); err != nil {
+	if _, _, err := sync(sc, aDir, filepath.Join(string(serverRoot), name)); err != nil {
 		return err
 	}
 	cmd := fmt.Sprintf("cd %q; set -x;\n", filepath.Join(string(serverRoot), name))
 	if a.Build != nil {
 		cmd += *a.Build + "\n"
 	}
-	cmd += fmt.Sprintf(`systemctl restart %s.target`, name)
+	if bg := a.BlueGreen; bg != nil {
+		s, hc := strings.TrimSuffix(bg.Service, ".service"), bg.HealthCheck
+		cmd += fmt.Sprintf(`set -e
+          f=%[1]q old=$(cat %[1]q 2> /dev/null || echo green) new=blue
+          if [ "$old" = blue ]; then new=green; fi
+          if [ "$new" = blue ]; then target=%[2]q; else target=%[3]q; fi
+          systemctl restart %[4]s@$new.service
+          if ! %[5]q health --path %[6]q --status %[7]d "$target"; then systemctl stop %[4]s@$new.service; exit 1; fi
+          mkdir -p "$(dirname "$f")" && echo $new > "$f"
+          systemctl add-wants %[8]s.target %[4]s@$new.service
+          rm -f /etc/systemd/system/%[8]s.target.wants/%[4]s@$old.service
+          systemctl reload k-http.service
+          sleep 5 # let in-flight requests finish
+          systemctl stop %[4]s@$old.service`,
+			config.ColorFile(name), bg.Targets["blue"], bg.Targets["green"], s, serverBin, hc.Path, hc.Status, name)
+	} else if a.IsOnDemand() {
+		// stopped apps are started by k-http on the next request
+		cmd += fmt.Sprintf(`systemctl try-restart %s.target`, name)
+	} else {
+		cmd += fmt.Sprintf(`systemctl restart %s.target`, name)
+	}
+	if a.HasSplit() {
+		// reset canary weights to the configured ones
+		cmd += fmt.Sprintf("\nif rm %q 2> /dev/null; then systemctl reload k-http.service; fi", config.CanaryFile(name))
+	}
 	_, err := util.SSHExec(sc, cmd, false)
 	return err
 }
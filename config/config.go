@@ -35,6 +35,16 @@ type App struct {
 	Build, Deploy *string
 	Env           map[string]string
 	Dependencies  []string
+	BlueGreen     *BlueGreen
+}
+
+// BlueGreen runs Service as the template Service@blue and Service@green. Deploys start the
+// inactive color, wait for it to pass HealthCheck, switch the app's proxy routes without
+// Target(s) over to it and stop the previously active color.
+type BlueGreen struct {
+	Service     string
+	Targets     map[string]string
+	HealthCheck server.HealthCheck
 }
 
 type Units map[string]Unit
@@ -75,7 +85,7 @@ func Load(dir string, fns template.FuncMap) (*C, error) {
 
 func (c *C) Render(dir, exe string) error {
 	for name, a := range c.Apps {
-		if err := a.Units.render(dir, name); err != nil {
+		if err := a.Units.render(dir, name, a.BlueGreen, a.UsesUnixSockets()); err != nil {
 			return err
 		}
 		if err := c.renderEnvFile(dir, name, a.Env); err != nil {
@@ -106,14 +116,32 @@ func (c *C) renderInternals(dir, exe string) error {
 		r.LogFields["K"] = "k-custom"
 		r.LogFields["SYSLOG_IDENTIFIER"] = "k-custom"
 	}
+	onDemandUnits, socketGroups := []string{}, []string{}
 	for name, a := range c.Apps {
-		reqs = append(reqs, name+".target")
+		if !a.IsOnDemand() {
+			reqs = append(reqs, name+".target")
+		}
+		if a.UsesUnixSockets() {
+			socketGroups = append(socketGroups, a.Units.users()...)
+		}
 		for _, r := range a.Routes {
 			if r.LogFields == nil {
 				r.LogFields = map[string]string{}
 			}
 			r.LogFields["K"] = name
 			r.LogFields["SYSLOG_IDENTIFIER"] = "k-http"
+			if a.BlueGreen != nil && r.Target == "" && len(r.Targets) == 0 {
+				r.BlueGreen = &server.BlueGreen{ColorFile: ColorFile(name), Targets: a.BlueGreen.Targets}
+			}
+			if r.Split != nil {
+				r.Split.CanaryFile = CanaryFile(name)
+			}
+			if r.OnDemand != nil {
+				if r.OnDemand.Unit == "" {
+					r.OnDemand.Unit = name + ".target"
+				}
+				onDemandUnits = append(onDemandUnits, r.OnDemand.Unit)
+			}
 			sc.Routes = append(sc.Routes, r)
 		}
 	}
@@ -131,6 +159,8 @@ func (c *C) renderInternals(dir, exe string) error {
 	}
 	if err := notifyService.render(dir, "k-notify@.service"); err != nil {
 		return err
+	} else if err := renderCertsCheck(dir, exe); err != nil {
+		return err
 	}
 	httpServer := Units{
 		"k-http.socket": {
@@ -149,16 +179,25 @@ func (c *C) renderInternals(dir, exe string) error {
 		},
 		"k-http.service": {
 			"Service": {
-				"ExecStart": fmt.Sprintf(`%s serve ${K_CONFIG_DIR}/k/k-http.json`, exe),
-				"Restart":   "always",
+				"ExecStart":  fmt.Sprintf(`%s serve ${K_CONFIG_DIR}/k/k-http.json`, exe),
+				"ExecReload": "kill -HUP $MAINPID",
+				"Restart":    "always",
 			},
 		},
 	}
-	if err := httpServer.render(dir, "k-http"); err != nil {
+	if len(socketGroups) != 0 {
+		sort.Strings(socketGroups)
+		httpServer["k-http.service"]["Service"]["SupplementaryGroups"] = strings.Join(socketGroups, " ")
+	}
+	if err := httpServer.render(dir, "k-http", nil, false); err != nil {
 		return err
 	}
 	if err := writeFile(fmt.Sprintf("%s/k/k-http.env", dir), "", 0600); err != nil {
 		return err
+	} else if err := renderPolkitRules(dir, onDemandUnits); err != nil {
+		return err
+	} else if err := renderSysusers(dir, socketGroups); err != nil {
+		return err
 	}
 	serverConfigPath := filepath.Join(dir, "k", "k-http.json")
 	sort.Slice(sc.Routes, func(i, j int) bool { return sc.Routes[i].Target < sc.Routes[j].Target })
@@ -181,14 +220,146 @@ func (c *C) renderInternals(dir, exe string) error {
 		filepath.Join(dir, "multi-user.target.wants", "k.target"))
 }
 
+// CanaryFile stores the canary percentage of the Split routes of an app (see k canary).
+func CanaryFile(app string) string {
+	return fmt.Sprintf("/var/lib/k/%s.canary", app)
+}
+
+// ColorFile stores the active color of a BlueGreen app.
+func ColorFile(app string) string {
+	return fmt.Sprintf("/var/lib/k/%s.color", app)
+}
+
+// renderCertsCheck runs k certs --check daily and notifies about expiring certificates via OnFailure.
+// It runs as the k-http user to read the certificate caches of k-http.
+func renderCertsCheck(dir, exe string) error {
+	service := Unit{
+		"Unit": {"OnFailure": "k-notify@%N.service"},
+		"Service": {
+			"Type":             "oneshot",
+			"ExecStart":        fmt.Sprintf("%s certs --check", exe),
+			"DynamicUser":      "true",
+			"User":             "k-http",
+			"StateDirectory":   "k-http",
+			"CacheDirectory":   "k-http",
+			"SyslogIdentifier": "k-http",
+			"LogExtraFields":   []any{"K=k-http"},
+		},
+	}
+	timer := Unit{
+		"Unit":  {"PartOf": "k.target"},
+		"Timer": {"OnCalendar": "daily", "RandomizedDelaySec": "1h", "Persistent": "true"},
+	}
+	if err := service.render(dir, "k-certs.service"); err != nil {
+		return err
+	} else if err := timer.render(dir, "k-certs.timer"); err != nil {
+		return err
+	}
+	return util.WriteSymlink(filepath.Join("..", "k-certs.timer"), filepath.Join(dir, "timers.target.wants", "k-certs.timer"))
+}
+
+// renderPolkitRules allows k-http to start and stop the units of OnDemand routes.
+func renderPolkitRules(dir string, units []string) error {
+	sort.Strings(units)
+	bs, err := json.Marshal(units)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "k", "k-http.rules"), fmt.Sprintf(`// generated by k
+polkit.addRule(function(action, subject) {
+  if (action.id == "org.freedesktop.systemd1.manage-units" && subject.user == "k-http" &&
+      %s.indexOf(action.lookup("unit")) != -1 &&
+      ["start", "stop"].indexOf(action.lookup("verb")) != -1) {
+    return polkit.Result.YES;
+  }
+});
+`, bs), 0644)
+}
+
+// renderSysusers creates static groups for the services of apps with unix socket upstreams. A service
+// with DynamicUser uses an existing group of its name, so files in its RuntimeDirectory stay
+// accessible to k-http (via SupplementaryGroups) while the service is stopped and restarted.
+func renderSysusers(dir string, groups []string) error {
+	s := "# generated by k\n"
+	for _, g := range groups {
+		s += fmt.Sprintf("g %s -\n", g)
+	}
+	return writeFile(filepath.Join(dir, "k", "k-http.sysusers"), s, 0644)
+}
+
+// UsesUnixSockets reports whether k-http proxies to the app via unix sockets, e.g. unix:/run/app/http.sock.
+func (a *App) UsesUnixSockets() bool {
+	targets := []string{}
+	for _, r := range a.Routes {
+		targets = append(append(targets, r.Target), r.Targets...)
+	}
+	if a.BlueGreen != nil {
+		for _, t := range a.BlueGreen.Targets {
+			targets = append(targets, t)
+		}
+	}
+	for _, t := range targets {
+		if strings.HasPrefix(t, "unix:") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSplit reports whether the app has Split routes, i.e. supports k canary.
+func (a *App) HasSplit() bool {
+	for _, r := range a.Routes {
+		if r.Split != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOnDemand reports whether the app is started by k-http on request rather than on boot.
+func (a *App) IsOnDemand() bool {
+	for _, r := range a.Routes {
+		if r.OnDemand != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// users returns the (DynamicUser) users of the services.
+func (us Units) users() []string {
+	users := []string{}
+	for name := range us {
+		if filepath.Ext(name) == ".service" {
+			users = append(users, strings.TrimSuffix(strings.TrimSuffix(name, ".service"), "@"))
+		}
+	}
+	return users
+}
+
 // TODO: use %y for K_CONFIG_DIR in 251/ubuntu 24 https://github.com/systemd/systemd/pull/22195
-func (us Units) render(dir, appName string) error {
+// With sharedRuntimeDir the RuntimeDirectory is only accessible to the service and its group (see renderSysusers)
+// and UMask keeps the sockets created in it group-writable.
+func (us Units) render(dir, appName string, bg *BlueGreen, sharedRuntimeDir bool) error {
 	target, reqs := appName+".target", []string{}
 	for name, u := range us {
-		reqs = append(reqs, name)
 		u = mergeUnits(Unit{"Unit": {"PartOf": target + " " + "k.target"}}, u)
+		if bg != nil && name == bg.Service {
+			// the active color is added to target.wants by deploys
+			name = strings.TrimSuffix(name, ".service")
+			u = mergeUnits(Unit{
+				"Service": {
+					"User":             name,
+					"RuntimeDirectory": name + "-%i",
+					"Environment":      []any{"K_COLOR=%i"},
+				},
+			}, u)
+			name += "@.service"
+		} else {
+			reqs = append(reqs, name)
+		}
 		if filepath.Ext(name) == ".service" {
-			name := strings.TrimSuffix(name, ".service")
+			name := strings.TrimSuffix(strings.TrimSuffix(name, ".service"), "@")
 			u = mergeUnits(Unit{
 				"Service": {
 					"SyslogIdentifier": name,
@@ -196,11 +367,15 @@ func (us Units) render(dir, appName string) error {
 					"DynamicUser":      "true",
 					"StateDirectory":   name,
 					"CacheDirectory":   name,
+					"RuntimeDirectory": name,
 					"Environment":      []any{"K_CONFIG_DIR=/opt/k/_"},
 					"EnvironmentFile":  []any{fmt.Sprintf("/opt/k/_/k/%s.env", appName)},
 					"Restart":          "always",
 				},
 			}, u)
+			if sharedRuntimeDir {
+				u = mergeUnits(Unit{"Service": {"RuntimeDirectoryMode": "0750", "UMask": "0007"}}, u)
+			}
 		}
 		if err := u.render(dir, name); err != nil {
 			return err
@@ -308,6 +483,23 @@ func parseApp(f, name string, fns template.FuncMap, vars interface{}) (*App, err
 	if a.Build != nil && a.Deploy != nil {
 		return nil, fmt.Errorf(".Build and .Deploy cannot be used in combination")
 	}
+	if bg := a.BlueGreen; bg != nil {
+		if bg.Service == "" {
+			bg.Service = name + ".service"
+		}
+		if bg.Targets == nil {
+			s := strings.TrimSuffix(bg.Service, ".service")
+			bg.Targets = map[string]string{
+				"blue":  fmt.Sprintf("unix:/run/%s-blue/http.sock", s),
+				"green": fmt.Sprintf("unix:/run/%s-green/http.sock", s),
+			}
+		}
+		if a.Units[bg.Service] == nil {
+			return nil, fmt.Errorf("BlueGreen.Service %q is not defined in Units", bg.Service)
+		} else if bg.Targets["blue"] == "" || bg.Targets["green"] == "" {
+			return nil, fmt.Errorf("BlueGreen.Targets requires blue and green")
+		}
+	}
 	return a, nil
 }
 
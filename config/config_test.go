@@ -3,9 +3,13 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"text/template"
+
+	"github.com/niklasfasching/k/server"
 )
 
 func TestConfig(t *testing.T) {
@@ -51,3 +55,38 @@ func TestConfig(t *testing.T) {
 		t.Fatal("actual config does not match generated.json")
 	}
 }
+
+func TestRenderInternals(t *testing.T) {
+	c, dir := &C{Apps: map[string]*App{
+		"app": {
+			Units:  Units{"app.service": {"Service": {"ExecStart": "/opt/k/app/main"}}},
+			Routes: []*server.Route{{Patterns: []string{"/"}, Target: "unix:/run/app/http.sock"}},
+		},
+		"other": {
+			Units: Units{"other.service": {"Service": {"ExecStart": "/opt/k/other/main"}}},
+			Routes: []*server.Route{{Patterns: []string{"/other/"}, Targets: []string{"http://localhost:8080", "http://localhost:8081"},
+				Split: &server.Split{Weights: []int{100, 0}}}},
+		},
+	}}, t.TempDir()
+	if err := c.Render(dir, "/usr/bin/echo"); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		"app.service":                       "RuntimeDirectoryMode=0750\n",
+		"k-http.service":                    "SupplementaryGroups=app\n",
+		"k/k-http.sysusers":                 "g app -\n",
+		"k/k-http.json":                     `"CanaryFile": "/var/lib/k/other.canary"`,
+		"k-certs.service":                   "OnFailure=k-notify@%N.service\n",
+		"timers.target.wants/k-certs.timer": "OnCalendar=daily\n",
+	} {
+		bs, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(string(bs), expected) {
+			t.Fatalf("%s: expected %q in %q", file, expected, string(bs))
+		}
+	}
+	if bs, _ := os.ReadFile(filepath.Join(dir, "other.service")); strings.Contains(string(bs), "RuntimeDirectoryMode") {
+		t.Fatalf("other.service: unexpected RuntimeDirectoryMode: %q", string(bs))
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// EAB holds the external account binding credentials some CAs require for registration.
+// HMACKey is base64url encoded as handed out by the CA.
+type EAB struct {
+	KeyID, HMACKey string
+}
+
+// DNS01 obtains a single certificate for Hostnames (wildcards allowed) using dns-01
+// challenges published via the configured provider.
+type DNS01 struct {
+	Hostnames        []string
+	PropagationDelay Duration
+	RFC2136          *RFC2136
+}
+
+// DNSProvider publishes and removes the TXT records for dns-01 challenges.
+// fqdn is fully qualified, e.g. _acme-challenge.example.com.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+type dns01Manager struct {
+	sync.RWMutex
+	client   *acme.Client
+	cache    autocert.Cache
+	email    string
+	eab      *acme.ExternalAccountBinding
+	entries  []*DNS01
+	certs    map[string]*tls.Certificate
+	renewals *renewals
+}
+
+var dns01RenewBefore, dns01RetryInterval = 30 * 24 * time.Hour, time.Hour
+
+func (d *DNS01) provider() (DNSProvider, error) {
+	if d.RFC2136 != nil {
+		return d.RFC2136, nil
+	}
+	return nil, fmt.Errorf("dns01 %v: no provider configured", d.Hostnames)
+}
+
+func (e *EAB) binding() (*acme.ExternalAccountBinding, error) {
+	if e == nil {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(e.HMACKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("EAB: invalid HMACKey: %w", err)
+	}
+	return &acme.ExternalAccountBinding{KID: e.KeyID, Key: key}, nil
+}
+
+func newDNS01Manager(c *Config, eab *acme.ExternalAccountBinding, rs *renewals) (*dns01Manager, error) {
+	for _, d := range c.DNS01 {
+		if len(d.Hostnames) == 0 {
+			return nil, fmt.Errorf("dns01: Hostnames must not be empty")
+		} else if _, err := d.provider(); err != nil {
+			return nil, err
+		}
+	}
+	return &dns01Manager{
+		client:   &acme.Client{DirectoryURL: c.ACMEDirectoryURL},
+		cache:    rs.cache,
+		email:    c.LetsEncryptEmail,
+		eab:      eab,
+		entries:  c.DNS01,
+		certs:    map[string]*tls.Certificate{},
+		renewals: rs,
+	}, nil
+}
+
+func (m *dns01Manager) match(serverName string) *tls.Certificate {
+	serverName = strings.ToLower(serverName)
+	m.RLock()
+	defer m.RUnlock()
+	if c, ok := m.certs[serverName]; ok {
+		return c
+	}
+	return m.certs[wildcard(serverName)]
+}
+
+// run loads certificates from the cache and renews them once they expire within dns01RenewBefore.
+func (m *dns01Manager) run(ctx context.Context) error {
+	for {
+		for _, d := range m.entries {
+			if err := m.ensure(ctx, d); err != nil {
+				logJournal(fmt.Sprintf("dns01 %v: %s", d.Hostnames, err), "3", nil)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(dns01RetryInterval):
+		}
+	}
+}
+
+func (m *dns01Manager) ensure(ctx context.Context, d *DNS01) error {
+	key := dns01CacheKey(d)
+	cert := m.match(d.Hostnames[0])
+	if cert == nil {
+		if bs, err := m.cache.Get(ctx, key); err == nil {
+			if cert, err = decodeCertificate(bs); err != nil {
+				logJournal(fmt.Sprintf("dns01 %v: ignoring cached certificate: %s", d.Hostnames, err), "4", nil)
+			}
+		} else if err != autocert.ErrCacheMiss {
+			return err
+		}
+	}
+	if cert == nil || time.Until(cert.Leaf.NotAfter) < dns01RenewBefore {
+		logJournal(fmt.Sprintf("dns01 %v: obtaining certificate", d.Hostnames), "5", nil)
+		bs, c, err := m.obtain(ctx, d)
+		m.renewals.record(d.Hostnames[0], err)
+		if err != nil {
+			return err
+		} else if err := m.cache.Put(ctx, key, bs); err != nil {
+			return err
+		}
+		cert = c
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, h := range d.Hostnames {
+		m.certs[strings.ToLower(h)] = cert
+	}
+	return nil
+}
+
+func dns01CacheKey(d *DNS01) string {
+	return "dns01+" + strings.ToLower(strings.Join(d.Hostnames, ","))
+}
+
+func (m *dns01Manager) obtain(ctx context.Context, d *DNS01) ([]byte, *tls.Certificate, error) {
+	p, err := d.provider()
+	if err != nil {
+		return nil, nil, err
+	} else if err := m.register(ctx); err != nil {
+		return nil, nil, err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(d.Hostnames...))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		z, err := m.client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		} else if z.Status == acme.StatusValid {
+			continue
+		}
+		chal := (*acme.Challenge)(nil)
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, nil, fmt.Errorf("%s: no dns-01 challenge offered", z.Identifier.Value)
+		}
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+		if err := p.Present(ctx, fqdn, value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fqdn, err)
+		}
+		defer func() {
+			if err := p.CleanUp(context.Background(), fqdn, value); err != nil {
+				logJournal(fmt.Sprintf("dns01 %s: cleanup: %s", fqdn, err), "4", nil)
+			}
+		}()
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(time.Duration(d.PropagationDelay)):
+		}
+		if _, err := m.client.Accept(ctx, chal); err != nil {
+			return nil, nil, err
+		} else if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: d.Hostnames}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	bs, err := encodeCertificate(key, der)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := decodeCertificate(bs)
+	return bs, cert, err
+}
+
+func (m *dns01Manager) register(ctx context.Context) error {
+	if m.client.Key != nil {
+		return nil
+	}
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	m.client.Key = key
+	a := &acme.Account{ExternalAccountBinding: m.eab}
+	if m.email != "" {
+		a.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, a, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		m.client.Key = nil
+		return err
+	}
+	return nil
+}
+
+func (m *dns01Manager) accountKey(ctx context.Context) (*ecdsa.PrivateKey, error) {
+	if bs, err := m.cache.Get(ctx, "dns01_account+key"); err == nil {
+		if b, _ := pem.Decode(bs); b != nil {
+			return x509.ParseECPrivateKey(b.Bytes)
+		}
+		return nil, fmt.Errorf("invalid account key in cache")
+	} else if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, m.cache.Put(ctx, "dns01_account+key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bs}))
+}
+
+// encodeCertificate uses the same layout as autocert cache entries: the key followed by the chain.
+func encodeCertificate(key *ecdsa.PrivateKey, der [][]byte) ([]byte, error) {
+	bs, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bs})
+	for _, b := range der {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return out, nil
+}
+
+func decodeCertificate(bs []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(bs, bs)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return &cert, err
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type dnsServer struct {
+	sync.Mutex
+	net.Listener
+	secret  []byte
+	records map[string]bool
+}
+
+func TestRFC2136(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	s := startDNSServer(t, secret)
+	r := &RFC2136{
+		Server:      s.Addr().String(),
+		Zone:        "example.com",
+		TSIGKeyName: "k-http",
+		TSIGSecret:  base64.StdEncoding.EncodeToString(secret),
+	}
+	ctx := context.Background()
+	if err := r.Present(ctx, "_acme-challenge.example.com.", "a"); err != nil {
+		t.Fatal(err)
+	} else if err := r.Present(ctx, "_acme-challenge.example.com.", "b"); err != nil {
+		t.Fatal(err)
+	} else if err := r.CleanUp(ctx, "_acme-challenge.example.com.", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.has("_acme-challenge.example.com. a") || !s.has("_acme-challenge.example.com. b") {
+		t.Fatalf("unexpected records: %v", s.records)
+	}
+
+	r.TSIGSecret = base64.StdEncoding.EncodeToString([]byte("wrong"))
+	if err := r.Present(ctx, "_acme-challenge.example.com.", "c"); err == nil || s.has("_acme-challenge.example.com. c") {
+		t.Fatal("expected update with wrong TSIG secret to be refused")
+	}
+	r.TSIGKeyName = ""
+	if err := r.Present(ctx, "_acme-challenge.example.com.", "c"); err == nil {
+		t.Fatal("expected unsigned update to be refused")
+	}
+}
+
+func TestDNS01Cache(t *testing.T) {
+	ca, err := newLocalCA(LocalCA{CertFile: t.TempDir() + "/ca.crt", KeyFile: t.TempDir() + "/ca.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.certificate("*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := encodeCertificate(cert.PrivateKey.(*ecdsa.PrivateKey), cert.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{LetsEncryptCachePath: t.TempDir(), DNS01: []*DNS01{{
+		Hostnames: []string{"*.example.com", "example.com"},
+		RFC2136:   &RFC2136{Server: "127.0.0.1:0", Zone: "example.com"},
+	}}}
+	cache := autocert.DirCache(c.LetsEncryptCachePath)
+	if err := cache.Put(context.Background(), "dns01+*.example.com,example.com", bs); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newDNS01Manager(c, nil, loadRenewals(context.Background(), cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewBefore := dns01RenewBefore
+	dns01RenewBefore = 0
+	defer func() { dns01RenewBefore = renewBefore }()
+	if err := m.ensure(context.Background(), c.DNS01[0]); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"www.example.com": true, "example.com": true, "a.b.example.com": false} {
+		if (m.match(name) != nil) != expected {
+			t.Fatalf("%s: expected match to be %v", name, expected)
+		}
+	}
+	if _, err := newDNS01Manager(&Config{DNS01: []*DNS01{{Hostnames: []string{"example.com"}}}}, nil, nil); err == nil {
+		t.Fatal("expected error for DNS01 without provider")
+	}
+}
+
+// startDNSServer accepts signed dynamic updates for TXT records and refuses everything else.
+func startDNSServer(t *testing.T, secret []byte) *dnsServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{Listener: l, secret: secret, records: map[string]bool{}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) has(record string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.records[record]
+}
+
+func (s *dnsServer) serve(c net.Conn) {
+	defer c.Close()
+	bs := make([]byte, 2)
+	if _, err := io.ReadFull(c, bs); err != nil {
+		return
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(bs))
+	if _, err := io.ReadFull(c, msg); err != nil {
+		return
+	}
+	h, rcode := s.handle(msg)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, RCode: rcode})
+	res, _ := b.Finish()
+	c.Write(append([]byte{byte(len(res) >> 8), byte(len(res))}, res...))
+}
+
+func (s *dnsServer) handle(msg []byte) (dnsmessage.Header, dnsmessage.RCode) {
+	p := dnsmessage.Parser{}
+	h, err := p.Start(msg)
+	if err != nil || h.OpCode != dnsOpCodeUpdate {
+		return h, dnsmessage.RCodeFormatError
+	}
+	q, err := p.Question()
+	if err != nil || q.Type != dnsmessage.TypeSOA || q.Name.String() != "example.com." {
+		return h, dnsmessage.RCodeRefused
+	}
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	type update struct {
+		name, value string
+		remove      bool
+	}
+	updates := []update{}
+	for {
+		rh, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil || rh.Type != dnsmessage.TypeTXT {
+			return h, dnsmessage.RCodeFormatError
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return h, dnsmessage.RCodeFormatError
+		}
+		updates = append(updates, update{rh.Name.String(), txt.TXT[0], rh.Class == dnsClassNone})
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil || len(additionals) != 1 || additionals[0].Header.Type != dnsTypeTSIG {
+		return h, dnsmessage.RCodeRefused
+	}
+	rdata := additionals[0].Body.(*dnsmessage.UnknownResource).Data
+	keyName, _ := wireName(additionals[0].Header.Name.String())
+	rr := len(keyName) + 10 + len(rdata)
+	unsigned := append([]byte{}, msg[:len(msg)-rr]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+	algorithmName, _ := wireName("hmac-sha256.")
+	rest := rdata[len(algorithmName):]
+	timeSigned, fudge, macSize := rest[:6], rest[6:8], binary.BigEndian.Uint16(rest[8:10])
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(unsigned)
+	mac.Write(keyName)
+	mac.Write([]byte{0, 255, 0, 0, 0, 0})
+	mac.Write(algorithmName)
+	mac.Write(timeSigned)
+	mac.Write(fudge)
+	mac.Write([]byte{0, 0, 0, 0})
+	if !hmac.Equal(mac.Sum(nil), rest[10:10+macSize]) {
+		return h, dnsmessage.RCodeRefused
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, u := range updates {
+		if u.remove {
+			delete(s.records, u.name+" "+u.value)
+		} else {
+			s.records[u.name+" "+u.value] = true
+		}
+	}
+	return h, dnsmessage.RCodeSuccess
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Certificate struct {
+	Hostnames         []string
+	CertFile, KeyFile string
+}
+
+// LocalCA issues certificates for hostnames ending in one of Domains. The CA is created
+// on first use - add CertFile to the trust store of clients.
+type LocalCA struct {
+	Domains           []string
+	CertFile, KeyFile string
+}
+
+type certificates map[string]*tls.Certificate
+
+type localCA struct {
+	sync.Mutex
+	LocalCA
+	cert   *x509.Certificate
+	key    crypto.Signer
+	issued map[string]*tls.Certificate
+}
+
+var defaultLocalCADir = "/var/lib/k-http"
+
+// loadCertificates loads static cert/key pairs. Without Hostnames the DNS names of the cert are used.
+func loadCertificates(cs []Certificate) (certificates, error) {
+	m := certificates{}
+	for _, c := range cs {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+		hostnames := c.Hostnames
+		if len(hostnames) == 0 {
+			hostnames = cert.Leaf.DNSNames
+		}
+		for _, h := range hostnames {
+			m[strings.ToLower(h)] = &cert
+		}
+	}
+	return m, nil
+}
+
+func (cs certificates) match(serverName string) *tls.Certificate {
+	serverName = strings.ToLower(serverName)
+	if c, ok := cs[serverName]; ok {
+		return c
+	}
+	return cs[wildcard(serverName)]
+}
+
+const localCAName = "k-http local CA"
+
+func (c LocalCA) withDefaults() LocalCA {
+	if len(c.Domains) == 0 {
+		c.Domains = []string{".test", ".internal"}
+	}
+	if c.CertFile == "" {
+		c.CertFile = filepath.Join(defaultLocalCADir, "local-ca.crt")
+	}
+	if c.KeyFile == "" {
+		c.KeyFile = filepath.Join(defaultLocalCADir, "local-ca.key")
+	}
+	return c
+}
+
+func newLocalCA(c LocalCA) (*localCA, error) {
+	c = c.withDefaults()
+	ca := &localCA{LocalCA: c, issued: map[string]*tls.Certificate{}}
+	if _, err := os.Stat(c.CertFile); os.IsNotExist(err) {
+		return ca, ca.create()
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("local CA key is not a signer: %T", cert.PrivateKey)
+	}
+	ca.key = key
+	ca.cert, err = x509.ParseCertificate(cert.Certificate[0])
+	return ca, err
+}
+
+func (ca *localCA) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: localCAName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ca.KeyFile), 0700); err != nil {
+		return err
+	} else if err := os.WriteFile(ca.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(ca.CertFile), 0755); err != nil {
+		return err
+	} else if err := os.WriteFile(ca.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	ca.key = key
+	ca.cert, err = x509.ParseCertificate(der)
+	return err
+}
+
+func (ca *localCA) matches(serverName string) bool {
+	for _, d := range ca.Domains {
+		if d := "." + strings.TrimPrefix(d, "."); serverName != d[1:] && strings.HasSuffix(serverName, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxLocalCACertificates bounds the cache of issued certificates - expired ones are evicted first.
+var maxLocalCACertificates = 1000
+
+// certificate returns a cached certificate for serverName or issues a new one that is valid for 30 days.
+func (ca *localCA) certificate(serverName string) (*tls.Certificate, error) {
+	serverName = strings.ToLower(serverName)
+	ca.Lock()
+	defer ca.Unlock()
+	if c := ca.issued[serverName]; c != nil && time.Until(c.Leaf.NotAfter) > 7*24*time.Hour {
+		return c, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 30),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+	if len(ca.issued) >= maxLocalCACertificates {
+		ca.evict(now)
+	}
+	ca.issued[serverName] = c
+	return c, nil
+}
+
+func (ca *localCA) evict(now time.Time) {
+	oldest := ""
+	for name, c := range ca.issued {
+		if now.After(c.Leaf.NotAfter) {
+			delete(ca.issued, name)
+		} else if oldest == "" || c.Leaf.NotAfter.Before(ca.issued[oldest].Leaf.NotAfter) {
+			oldest = name
+		}
+	}
+	if len(ca.issued) >= maxLocalCACertificates {
+		delete(ca.issued, oldest)
+	}
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// wildcard returns the wildcard name matching serverName, e.g. *.example.com for www.example.com.
+func wildcard(serverName string) string {
+	if i := strings.IndexByte(serverName, '.'); i != -1 {
+		return "*" + serverName[i:]
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := newLocalCA(LocalCA{CertFile: filepath.Join(dir, "ca.crt"), KeyFile: filepath.Join(dir, "ca.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"app.test": true, "a.b.internal": true, "test": false, "example.com": false} {
+		if ca.matches(name) != expected {
+			t.Fatalf("%s: expected match to be %v", name, expected)
+		}
+	}
+	cert, err := ca.certificate("app.test")
+	if err != nil {
+		t.Fatal(err)
+	} else if cert2, _ := ca.certificate("app.test"); cert2 != cert {
+		t.Fatal("expected issued certificate to be cached")
+	}
+	defer func(max int) { maxLocalCACertificates = max }(maxLocalCACertificates)
+	maxLocalCACertificates, cert.Leaf.NotAfter = 2, cert.Leaf.NotAfter.Add(-time.Hour)
+	for _, name := range []string{"b.test", "c.test"} {
+		if _, err := ca.certificate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := ca.issued["app.test"]; len(ca.issued) != 2 || ok {
+		t.Fatalf("expected oldest issued certificate to be evicted: %v", ca.issued)
+	}
+	ca2, err := newLocalCA(ca.LocalCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca2.cert)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "app.test", Roots: roots}); err != nil {
+		t.Fatalf("expected certificate to be signed by the persisted CA: %s", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "wildcard.crt"), filepath.Join(dir, "wildcard.key")
+	wildcard, err := ca.certificate("*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(wildcard.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: wildcard.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := loadCertificates([]Certificate{{CertFile: certFile, KeyFile: keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"www.example.com": true, "WWW.example.com": true, "example.com": false, "a.b.example.com": false} {
+		if (certs.match(name) != nil) != expected {
+			t.Fatalf("%s: expected match to be %v", name, expected)
+		}
+	}
+	if c := certs.match("www.example.com"); time.Until(c.Leaf.NotAfter) < 24*time.Hour {
+		t.Fatal("expected parsed leaf")
+	}
+}
+
+func TestCertInventory(t *testing.T) {
+	dir, ctx := t.TempDir(), context.Background()
+	ca, err := newLocalCA(LocalCA{CertFile: filepath.Join(dir, "ca.crt"), KeyFile: filepath.Join(dir, "ca.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeCert, err := ca.certificate("acme.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := encodeCertificate(acmeCert.PrivateKey.(*ecdsa.PrivateKey), acmeCert.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	cache := recordingCache{autocert.DirCache(cacheDir), loadRenewals(ctx, autocert.DirCache(cacheDir))}
+	if err := cache.Put(ctx, "acme.example.com", bs); err != nil {
+		t.Fatal(err)
+	} else if err := cache.Put(ctx, "token+http-01", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	cache.renewals.record("failing.example.com", errors.New("rate limited"))
+
+	c := &Config{
+		LetsEncryptEmail:     "admin@example.com",
+		LetsEncryptCachePath: cacheDir,
+		LocalCA:              &LocalCA{},
+		Routes: []*Route{
+			{Patterns: []string{"acme.example.com/", "failing.example.com/"}},
+			{Patterns: []string{"app.test/", "/", "ACME.example.com/api/"}},
+		},
+	}
+	infos, err := c.CertInventory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 3 {
+		t.Fatalf("expected 3 hostnames: %v", infos)
+	}
+	if i := infos[0]; i.Hostname != "acme.example.com" || i.Source != "acme" || i.Issuer != localCAName ||
+		!i.NotAfter.Equal(acmeCert.Leaf.NotAfter) || i.LastAttempt.IsZero() || i.LastError != "" {
+		t.Fatalf("unexpected acme info: %#v", i)
+	}
+	if i := infos[1]; i.Hostname != "app.test" || i.Source != "local CA" {
+		t.Fatalf("unexpected local CA info: %#v", i)
+	}
+	if i := infos[2]; i.Hostname != "failing.example.com" || !i.NotAfter.IsZero() || i.LastError != "rate limited" {
+		t.Fatalf("unexpected failing info: %#v", i)
+	}
+	if msgs, err := c.ExpiringCertificates(ctx); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected no expiring certificates: %v %v", msgs, err)
+	}
+	c.CertExpiryWarningDays = 31
+	if msgs, err := c.ExpiringCertificates(ctx); err != nil || len(msgs) != 1 || !strings.HasPrefix(msgs[0], "certificate for acme.example.com (acme) expires in") {
+		t.Fatalf("expected acme.example.com to expire: %v %v", msgs, err)
+	}
+}
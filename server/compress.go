@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Compress struct {
+	MinSize int
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+// precompressed files are tried in order of preference. We only compress with gzip on the fly -
+// brotli and zstd are served if precompressed files exist next to the originals.
+var precompressed = []struct{ encoding, ext string }{{"br", ".br"}, {"zstd", ".zst"}, {"gzip", ".gz"}}
+
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "text/event-stream",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz",
+	"application/octet-stream", "application/wasm",
+}
+
+var defaultCompressMinSize = 1024
+
+// CompressHandler gzips responses of compressible content types once they reach MinSize.
+// Responses that already have a Content-Encoding (e.g. from upstreams) are left alone.
+func CompressHandler(next http.Handler, c Compress) http.Handler {
+	if c.MinSize == 0 {
+		c.MinSize = defaultCompressMinSize
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, minSize: c.MinSize}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// PrecompressedHandler serves $file.br, $file.zst or $file.gz instead of $file if the client
+// accepts the encoding and the file exists.
+func PrecompressedHandler(next http.Handler, root string) http.Handler {
+	dir := http.Dir(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, p := range precompressed {
+			if !acceptsEncoding(r, p.encoding) {
+				continue
+			}
+			f, err := dir.Open(name + p.ext)
+			if err != nil {
+				continue
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil || fi.IsDir() {
+				continue
+			} else {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Encoding", p.encoding)
+				http.ServeContent(w, r, name, fi.ModTime(), f)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(bs []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, bs...)
+		if len(cw.buf) < cw.minSize {
+			return len(bs), nil
+		}
+		return len(bs), cw.decide()
+	} else if cw.gz != nil {
+		return cw.gz.Write(bs)
+	}
+	return cw.ResponseWriter.Write(bs)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide()
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return cw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (cw *compressWriter) Close() error {
+	if !cw.decided && cw.status != 0 {
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) != 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if cw.status == http.StatusOK && len(cw.buf) >= cw.minSize &&
+		h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		cw.gz = gzip.NewWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	bs := cw.buf
+	cw.buf = nil
+	if len(bs) == 0 {
+		return nil
+	} else if cw.gz != nil {
+		_, err := cw.gz.Write(bs)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(bs)
+	return err
+}
+
+func isCompressible(contentType string) bool {
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		return true
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), ";", 2)
+		if strings.TrimSpace(kv[0]) != encoding && strings.TrimSpace(kv[0]) != "*" {
+			continue
+		} else if len(kv) == 1 {
+			return true
+		} else if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(kv[1]), "q="), 64); err == nil {
+			return q > 0
+		}
+	}
+	return false
+}
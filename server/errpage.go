@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type errPageWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	page        func(w http.ResponseWriter, r *http.Request, status int) bool
+	wroteHeader bool
+	intercepted bool
+}
+
+// errPageHeaders describe the original body and are dropped when it is replaced.
+var errPageHeaders = []string{
+	"Content-Length", "Content-Type", "Content-Encoding", "Content-Range", "Content-Disposition",
+	"Accept-Ranges", "ETag", "Last-Modified",
+}
+
+var errPageClient = &http.Client{
+	Timeout:       5 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// ErrPageHandler replaces the body of error responses with the page configured for the status
+// (0 matches any status >= 400). The status code is kept. Pages are
+//   - http(s) urls that are fetched for each response
+//   - file: paths that are read from disk - relative paths are resolved against root
+//   - other paths, e.g. /errors/404.html. They are read from root for static routes and
+//     requested from next (i.e. the upstream of the route) otherwise
+//
+// Pages that cannot be loaded are logged and skipped. Files ending in .tmpl (e.g. 404.html.tmpl)
+// are html templates with .status, .statusText, .requestId, .method, .host and .url.
+// Fetched pages receive those as X-Error-Status, X-Request-Id and X-Original-Url headers.
+func ErrPageHandler(next http.Handler, errPaths map[int]string, root string) http.Handler {
+	pages := map[int]func(http.ResponseWriter, *http.Request, int){}
+	for status, p := range errPaths {
+		if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+			pages[status] = proxyErrPage(p)
+			continue
+		} else if strings.HasPrefix(p, "file:") {
+			if p = strings.TrimPrefix(p, "file:"); !filepath.IsAbs(p) {
+				p = filepath.Join(root, p)
+			}
+		} else if root != "" {
+			p = filepath.Join(root, p)
+		} else {
+			pages[status] = routeErrPage(next, "/"+strings.TrimPrefix(p, "/"))
+			continue
+		}
+		if page, err := fileErrPage(p); err != nil {
+			log.Printf("ErrPaths[%d]: %s - serving default error page", status, err)
+		} else {
+			pages[status] = page
+		}
+	}
+	page := func(w http.ResponseWriter, r *http.Request, status int) bool {
+		p, ok := pages[status]
+		if !ok && status >= 400 {
+			p, ok = pages[0]
+		}
+		if ok {
+			for _, k := range errPageHeaders {
+				w.Header().Del(k)
+			}
+			p(w, r, status)
+		}
+		return ok
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errPageWriter{ResponseWriter: w, r: r, page: page}, r)
+	})
+}
+
+func fileErrPage(p string) (func(http.ResponseWriter, *http.Request, int), error) {
+	bs, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	name, t := strings.TrimSuffix(p, ".tmpl"), (*template.Template)(nil)
+	if name != p {
+		if t, err = template.New(path.Base(p)).Parse(string(bs)); err != nil {
+			return nil, err
+		}
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		body := bs
+		if t != nil {
+			b := &bytes.Buffer{}
+			err := t.Execute(b, map[string]interface{}{
+				"status":     status,
+				"statusText": http.StatusText(status),
+				"requestId":  r.Header.Get("X-Request-Id"),
+				"method":     r.Method,
+				"host":       r.Host,
+				"url":        r.URL.String(),
+			})
+			if err != nil {
+				logJournal(fmt.Sprintf("err page %s: %s", p, err), "3", nil)
+				http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+				return
+			}
+			body = b.Bytes()
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	}, nil
+}
+
+// routeErrPage requests the page from next - conditional, range and compression headers of the
+// original request are dropped so we get the full page.
+func routeErrPage(next http.Handler, p string) func(http.ResponseWriter, *http.Request, int) {
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		r2 := r.Clone(r.Context())
+		r2.Method, r2.Body, r2.ContentLength = http.MethodGet, http.NoBody, 0
+		r2.URL, r2.RequestURI = &url.URL{Path: p}, p
+		for _, k := range []string{"Accept-Encoding", "Range", "If-Range", "If-Modified-Since", "If-None-Match"} {
+			r2.Header.Del(k)
+		}
+		res := &bufferedResponse{header: http.Header{}}
+		next.ServeHTTP(res, r2)
+		if res.status != http.StatusOK {
+			logJournal(fmt.Sprintf("err page %s: status %d", p, res.status), "3", nil)
+			http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+			return
+		}
+		if contentType := res.header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			w.Write(res.body.Bytes())
+		}
+	}
+}
+
+func proxyErrPage(url string) func(http.ResponseWriter, *http.Request, int) {
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+			return
+		}
+		req.Header.Set("X-Error-Status", fmt.Sprint(status))
+		req.Header.Set("X-Original-Url", r.URL.String())
+		req.Header.Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+		res, err := errPageClient.Do(req)
+		if err != nil {
+			logJournal(fmt.Sprintf("err page %s: %s", url, err), "3", nil)
+			http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+			return
+		}
+		defer res.Body.Close()
+		if contentType := res.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, res.Body)
+		}
+	}
+}
+
+func (w *errPageWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.intercepted = w.page(w.ResponseWriter, w.r, status); !w.intercepted {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *errPageWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted {
+		return len(bs), nil
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *errPageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.intercepted {
+		f.Flush()
+	}
+}
+
+func (w *errPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(bs []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(bs)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertInfo describes the certificate served for Hostname. LastAttempt and LastError
+// are only known for certificates obtained via ACME.
+type CertInfo struct {
+	Hostname, Source, Issuer string
+	NotAfter, LastAttempt    time.Time
+	LastError                string
+}
+
+type renewal struct {
+	Time  time.Time
+	Error string
+}
+
+// renewals records ACME attempts in the cache so they survive restarts and can be
+// read by k certs. autocert does not expose failed background renewals, so for it
+// we only see successful ones (cache writes) and failed synchronous issuance.
+type renewals struct {
+	sync.Mutex
+	cache autocert.Cache
+	m     map[string]renewal
+}
+
+type recordingCache struct {
+	autocert.Cache
+	renewals *renewals
+}
+
+const renewalsKey = "k-http+renewals"
+
+func loadRenewals(ctx context.Context, cache autocert.Cache) *renewals {
+	rs := &renewals{cache: cache, m: map[string]renewal{}}
+	if bs, err := cache.Get(ctx, renewalsKey); err == nil {
+		json.Unmarshal(bs, &rs.m)
+	}
+	return rs
+}
+
+func (rs *renewals) record(hostname string, err error) {
+	rs.Lock()
+	defer rs.Unlock()
+	r := renewal{Time: time.Now()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	rs.m[strings.ToLower(hostname)] = r
+	bs, _ := json.Marshal(rs.m)
+	if err := rs.cache.Put(context.Background(), renewalsKey, bs); err != nil {
+		logJournal(fmt.Sprintf("failed to record renewal of %s: %s", hostname, err), "4", nil)
+	}
+}
+
+func (rs *renewals) get(hostname string) renewal {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.m[strings.ToLower(hostname)]
+}
+
+// Put records certificates written by autocert, i.e. successful issuance and renewal.
+func (c recordingCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	if !strings.Contains(key, "+") || strings.HasSuffix(key, "+rsa") {
+		c.renewals.record(strings.TrimSuffix(key, "+rsa"), err)
+	}
+	return err
+}
+
+// Hostnames returns the hostnames of all route patterns.
+func (c *Config) Hostnames() []string {
+	hostnames, seen := []string{}, map[string]bool{}
+	for _, r := range c.Routes {
+		for _, p := range r.Patterns {
+			if h := strings.ToLower(strings.SplitN(p, "/", 2)[0]); h != "" && !seen[h] {
+				hostnames, seen[h] = append(hostnames, h), true
+			}
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// CertInventory lists the certificate of each route hostname from the configured
+// certificates and the ACME cache.
+func (c *Config) CertInventory(ctx context.Context) ([]CertInfo, error) {
+	certs, err := loadCertificates(c.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	cache := autocert.DirCache(c.LetsEncryptCachePath)
+	rs, dns01 := loadRenewals(ctx, cache), certificates{}
+	for _, d := range c.DNS01 {
+		if bs, err := cache.Get(ctx, dns01CacheKey(d)); err == nil {
+			if cert, err := decodeCertificate(bs); err == nil {
+				for _, h := range d.Hostnames {
+					dns01[strings.ToLower(h)] = cert
+				}
+			}
+		}
+	}
+	ca := (*localCA)(nil)
+	if c.LocalCA != nil {
+		ca = &localCA{LocalCA: c.LocalCA.withDefaults()}
+	}
+	infos := []CertInfo{}
+	for _, h := range c.Hostnames() {
+		info, r := CertInfo{Hostname: h}, rs.get(h)
+		cert := certs.match(h)
+		if cert != nil {
+			info.Source = "static"
+		} else if ca != nil && ca.matches(h) {
+			info.Source, info.Issuer = "local CA", localCAName
+		} else if cert = dns01.match(h); cert != nil {
+			info.Source, r = "dns-01", rs.get(dns01Name(h, c.DNS01))
+		} else if c.LetsEncryptEmail != "" {
+			info.Source = "acme"
+			if bs, err := cache.Get(ctx, h); err == nil {
+				cert, _ = decodeCertificate(bs)
+			}
+		}
+		if cert != nil {
+			info.Issuer, info.NotAfter = cert.Leaf.Issuer.CommonName, cert.Leaf.NotAfter
+		}
+		info.LastAttempt, info.LastError = r.Time, r.Error
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// certLogFields tag certificate warnings so they show up in k logs k-http.
+var certLogFields = map[string]string{"K": "k-http", "SYSLOG_IDENTIFIER": "k-http"}
+
+// ExpiringCertificates describes the certificates that expire within CertExpiryWarningDays
+// (default 14) - with the default renewal 30 days before expiry that means renewal has been
+// failing for more than two weeks.
+func (c *Config) ExpiringCertificates(ctx context.Context) ([]string, error) {
+	warnDays := c.CertExpiryWarningDays
+	if warnDays == 0 {
+		warnDays = 14
+	}
+	infos, err := c.CertInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []string{}
+	for _, i := range infos {
+		if left := time.Until(i.NotAfter); !i.NotAfter.IsZero() && left < time.Duration(warnDays)*24*time.Hour {
+			msg := fmt.Sprintf("certificate for %s (%s) expires in %d days", i.Hostname, i.Source, int(left.Hours()/24))
+			if i.LastError != "" {
+				msg += fmt.Sprintf(" - last renewal attempt %s failed: %s", i.LastAttempt.Format(time.RFC3339), i.LastError)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// monitorCertificates logs ExpiringCertificates - notifications are sent by the k-certs timer (k certs --check).
+// The config is read from disk as routes may change on reload.
+func (c *Config) monitorCertificates(ctx context.Context) {
+	for {
+		cfg, msgs, err := c, []string(nil), error(nil)
+		if c.path != "" {
+			cfg, err = ReadConfig(c.path)
+		}
+		if err == nil {
+			msgs, err = cfg.ExpiringCertificates(ctx)
+		}
+		if err != nil {
+			logJournal(fmt.Sprintf("certificate inventory: %s", err), "4", certLogFields)
+		}
+		for _, msg := range msgs {
+			logJournal(msg, "4", certLogFields)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(12 * time.Hour):
+		}
+	}
+}
+
+func dns01Name(hostname string, ds []*DNS01) string {
+	for _, d := range ds {
+		for _, h := range d.Hostnames {
+			if h = strings.ToLower(h); h == hostname || h == wildcard(hostname) {
+				return d.Hostnames[0]
+			}
+		}
+	}
+	return hostname
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type cidrs []*net.IPNet
+
+// IPFilterHandler rejects requests from Deny and - if Allow is not empty - from anything not in Allow.
+func IPFilterHandler(next http.Handler, allow, deny []string, fields map[string]string) (http.Handler, error) {
+	allowed, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r.RemoteAddr)
+		if denied.contains(ip) || (len(allowed) != 0 && !allowed.contains(ip)) {
+			msg := fmt.Sprintf("denied %s: %s %s%s", ip, r.Method, r.Host, r.URL)
+			logJournal(msg, "4", fields)
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// realIPHandler replaces r.RemoteAddr with the client address from X-Forwarded-For - or
+// Forwarded if that is not set - if the request comes from a trusted proxy. The header is
+// truncated to the hops before the client, the reverse proxy appends the client again.
+func realIPHandler(next http.Handler, trusted cidrs) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, port, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := remoteIP(r.RemoteAddr); ip == nil || !trusted.contains(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header, hops, ips := "X-Forwarded-For", []string{}, []net.IP{}
+		for _, v := range r.Header.Values(header) {
+			for _, hop := range strings.Split(v, ",") {
+				hop = strings.TrimSpace(hop)
+				hops, ips = append(hops, hop), append(ips, net.ParseIP(hop))
+			}
+		}
+		if len(hops) == 0 {
+			header = "Forwarded"
+			for _, v := range r.Header.Values(header) {
+				for _, hop := range strings.Split(v, ",") {
+					hop = strings.TrimSpace(hop)
+					hops, ips = append(hops, hop), append(ips, forwardedFor(hop))
+				}
+			}
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := ips[i]
+			if ip == nil {
+				break
+			} else if trusted.contains(ip) && i != 0 {
+				continue
+			}
+			r2 := r.Clone(r.Context())
+			r2.RemoteAddr = net.JoinHostPort(ip.String(), port)
+			if i == 0 {
+				r2.Header.Del(header)
+			} else {
+				r2.Header.Set(header, strings.Join(hops[:i], ", "))
+			}
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the ip of the for= parameter of a Forwarded (RFC 7239) element,
+// e.g. for=192.0.2.60;proto=https or for="[2001:db8::1]:4711". Obfuscated and unknown
+// identifiers return nil.
+func forwardedFor(element string) net.IP {
+	for _, pair := range strings.Split(element, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if !strings.EqualFold(k, "for") {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		if strings.HasPrefix(v, "[") {
+			if i := strings.IndexByte(v, ']'); i != -1 {
+				return net.ParseIP(v[1:i])
+			}
+			return nil
+		} else if host, _, err := net.SplitHostPort(v); err == nil {
+			v = host
+		}
+		return net.ParseIP(v)
+	}
+	return nil
+}
+
+// forwardedHandler ensures every request has an X-Request-Id and drops X-Forwarded-Proto and
+// X-Forwarded-Host unless the request comes from a trusted proxy. Request ids from trusted
+// proxies are passed through, all others are replaced. The id is also sent to the client.
+func forwardedHandler(next http.Handler, trusted cidrs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !trusted.contains(remoteIP(r.RemoteAddr)) {
+			id = ""
+			r.Header.Del("X-Forwarded-Proto")
+			r.Header.Del("X-Forwarded-Host")
+		}
+		if !validRequestID(id) {
+			bs := make([]byte, 16)
+			rand.Read(bs)
+			id = hex.EncodeToString(bs)
+		}
+		r.Header.Set("X-Request-Id", id)
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:+/=", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCIDRs parses CIDRs as well as plain IPs.
+func parseCIDRs(vs []string) (cidrs, error) {
+	ns := cidrs{}
+	for _, v := range vs {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip == nil {
+				return nil, fmt.Errorf("bad ip: %q", v)
+			} else if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+func (ns cidrs) contains(ip net.IP) bool {
+	for _, n := range ns {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(remoteAddress string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
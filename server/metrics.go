@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metrics struct {
+	sync.Mutex
+	routes map[routeKey]*routeMetrics
+}
+
+type routeKey struct{ app, route string }
+
+type routeMetrics struct {
+	requests map[int]uint64
+	buckets  []uint64
+	sum      float64
+	count    uint64
+	bytes    uint64
+}
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// defaultMetrics is shared between reloads so counters keep increasing monotonically.
+var defaultMetrics = &metrics{routes: map[routeKey]*routeMetrics{}}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) observer(app, route string) func(status, size int, d time.Duration) {
+	k := routeKey{app, route}
+	return func(status, size int, d time.Duration) {
+		m.Lock()
+		defer m.Unlock()
+		rm := m.routes[k]
+		if rm == nil {
+			rm = &routeMetrics{requests: map[int]uint64{}, buckets: make([]uint64, len(durationBuckets))}
+			m.routes[k] = rm
+		}
+		rm.requests[status]++
+		rm.bytes += uint64(size)
+		rm.count++
+		rm.sum += d.Seconds()
+		for i, le := range durationBuckets {
+			if d.Seconds() <= le {
+				rm.buckets[i]++
+			}
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	keys := []routeKey{}
+	for k := range m.routes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].app < keys[j].app || (keys[i].app == keys[j].app && keys[i].route < keys[j].route)
+	})
+	s := &strings.Builder{}
+	labels := func(k routeKey) string {
+		return fmt.Sprintf(`app="%s",route="%s"`, labelEscaper.Replace(k.app), labelEscaper.Replace(k.route))
+	}
+	s.WriteString("# HELP k_http_requests_total Requests by route and status code.\n")
+	s.WriteString("# TYPE k_http_requests_total counter\n")
+	for _, k := range keys {
+		codes := []int{}
+		for code := range m.routes[k].requests {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(s, "k_http_requests_total{%s,code=\"%d\"} %d\n", labels(k), code, m.routes[k].requests[code])
+		}
+	}
+	s.WriteString("# HELP k_http_request_duration_seconds Request duration by route.\n")
+	s.WriteString("# TYPE k_http_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		rm := m.routes[k]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(s, "k_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels(k), le, rm.buckets[i])
+		}
+		fmt.Fprintf(s, "k_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(k), rm.count)
+		fmt.Fprintf(s, "k_http_request_duration_seconds_sum{%s} %g\n", labels(k), rm.sum)
+		fmt.Fprintf(s, "k_http_request_duration_seconds_count{%s} %d\n", labels(k), rm.count)
+	}
+	s.WriteString("# HELP k_http_response_bytes_total Response body bytes served by route.\n")
+	s.WriteString("# TYPE k_http_response_bytes_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(s, "k_http_response_bytes_total{%s} %d\n", labels(k), m.routes[k].bytes)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(s.String()))
+}
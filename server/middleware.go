@@ -2,113 +2,349 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/subtle"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
-
-	"github.com/niklasfasching/k/util"
 )
 
 type BasicAuth struct {
 	User     string
 	Password string
 	Realm    string
+	Users    map[string]string
+	Htpasswd string
+}
+
+type HSTS struct {
+	MaxAge            Duration
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+type StaticOptions struct {
+	SPAFallback      string
+	CleanURLs        bool
+	DirectoryListing bool
+	CacheControl     map[string]string
+}
+
+type fs struct {
+	http.FileSystem
+	StaticOptions
 }
 
-type fs struct{ http.FileSystem }
+type logInfoKey struct{}
+type logInfo struct{ upstream string }
 
 type responseWriter struct {
-	status   int
-	count    int
-	errPaths map[int]string
-	req      *http.Request
+	status int
+	count  int
 	http.ResponseWriter
 }
 
 var _ http.Hijacker = (*responseWriter)(nil)
 
+type defaultHeaderWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+var defaultHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"Referrer-Policy":         "strict-origin-when-cross-origin",
+	"Content-Security-Policy": "frame-ancestors 'self'",
+}
+
+var journalFields = map[string]string{
+	"remote": "HTTP_REMOTE", "userAgent": "HTTP_USER_AGENT", "proto": "HTTP_PROTO", "method": "HTTP_METHOD",
+	"host": "HTTP_HOST", "url": "HTTP_URL", "status": "HTTP_STATUS", "size": "HTTP_SIZE",
+	"durationMs": "HTTP_DURATION_MS", "upstream": "HTTP_UPSTREAM", "requestId": "HTTP_REQUEST_ID",
+}
+
+var redirectStatuses = map[int]bool{301: true, 302: true, 307: true, 308: true}
+
 var ipv4Mask = net.CIDRMask(16, 32)  // 255.255.0.0
 var ipv6Mask = net.CIDRMask(56, 128) // ffff:ffff:ffff:ff00::
-var commonLogFormat = `{{ .remote }} - {{ .userAgent }} [{{ .timestamp }}] "{{ .method }} {{ .host }}{{ .url }} {{ .proto }}" {{ .status }} {{ .size }}`
+var commonLogFormat = `{{ .remote }} - {{ .userAgent }} [{{ .timestamp }}] "{{ .method }} {{ .host }}{{ .url }} {{ .proto }}" {{ .status }} {{ .size }} {{ .requestId }}`
 
-func LogHandler(next http.Handler, format string,
-	fields map[string]string, errPaths map[int]string) (http.Handler, error) {
-	fmt, err := newLogFormatter(format)
+// LogHandler writes an access log line per request. With structured set the values are
+// additionally sent as journal fields, e.g. HTTP_STATUS=200 HTTP_DURATION_MS=12.
+func LogHandler(next http.Handler, format string, fields map[string]string, structured bool,
+	observers ...func(status, size int, d time.Duration)) (http.Handler, error) {
+	formatLog, err := newLogFormatter(format)
 	if err != nil {
 		return nil, err
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rw, timestamp := &responseWriter{ResponseWriter: w, req: r}, time.Now()
-		next.ServeHTTP(rw, r)
-		err := util.JournalLog(fmt(map[string]interface{}{
-			"remote":    maskIP(r.RemoteAddr),
-			"userAgent": r.UserAgent(),
-			"timestamp": timestamp.Format(time.RFC3339),
-			"proto":     r.Proto,
-			"method":    r.Method,
-			"host":      r.Host,
-			"url":       r.URL,
-			"status":    rw.status,
-			"size":      rw.count,
-		}), "6", fields)
-		if err != nil {
+		rw, li, timestamp := &responseWriter{ResponseWriter: w}, &logInfo{}, time.Now()
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), logInfoKey{}, li)))
+		duration := time.Since(timestamp)
+		for _, observe := range observers {
+			observe(rw.status, rw.count, duration)
+		}
+		vs := map[string]interface{}{
+			"remote":     maskIP(r.RemoteAddr),
+			"userAgent":  r.UserAgent(),
+			"timestamp":  timestamp.Format(time.RFC3339),
+			"proto":      r.Proto,
+			"method":     r.Method,
+			"host":       r.Host,
+			"url":        r.URL,
+			"status":     rw.status,
+			"size":       rw.count,
+			"duration":   duration,
+			"durationMs": duration.Milliseconds(),
+			"upstream":   li.upstream,
+			"requestId":  r.Header.Get("X-Request-Id"),
+		}
+		kvs := fields
+		if structured {
+			kvs = map[string]string{}
+			for k, v := range fields {
+				kvs[k] = v
+			}
+			for k, field := range journalFields {
+				if v := fmt.Sprint(vs[k]); v != "" {
+					kvs[field] = v
+				}
+			}
+		}
+		if err := journalLog(formatLog(vs), "6", kvs); err != nil {
 			log.Printf("journal log failed: %s", err)
 		}
 	}), nil
 }
 
-func StaticHandler(root string) (http.Handler, error) {
-	fs := &fs{http.FileSystem(http.Dir(root))}
-	return http.FileServer(fs), nil
+// StaticHandler serves files from root. Unless DirectoryListing is set directories are only
+// served if they contain an index.html. Missing paths without extension are tried as $path.html
+// with CleanURLs and fall back to SPAFallback. CacheControl maps path prefixes to Cache-Control values.
+func StaticHandler(root string, o StaticOptions) (http.Handler, error) {
+	fs := &fs{http.FileSystem(http.Dir(root)), o}
+	h, prefixes := http.FileServer(fs), []string{}
+	for prefix := range o.CacheControl {
+		prefixes = append(prefixes, prefix)
+	}
+	if len(prefixes) == 0 {
+		return h, nil
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := "/" + strings.TrimPrefix(r.URL.Path, "/")
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(p, "/"+strings.TrimPrefix(prefix, "/")) {
+				w.Header().Set("Cache-Control", o.CacheControl[prefix])
+				break
+			}
+		}
+		h.ServeHTTP(w, r)
+	}), nil
 }
 
-func ProxyHandler(uri string) (http.Handler, error) {
-	u, err := url.Parse(uri)
-	if err != nil {
-		return nil, err
+// RedirectHandler redirects to target after replacing the placeholders {host}, {path} and {query}.
+// {path} is the (stripped and rewritten) path the route sees, {query} includes the leading "?".
+func RedirectHandler(target string, status int) (http.Handler, error) {
+	if status == 0 {
+		status = http.StatusFound
+	} else if !redirectStatuses[status] {
+		return nil, fmt.Errorf("bad redirect status: %d", status)
 	}
-	return httputil.NewSingleHostReverseProxy(u), nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := ""
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, strings.NewReplacer(
+			"{host}", r.Host,
+			"{path}", "/"+strings.TrimPrefix(r.URL.Path, "/"),
+			"{query}", query,
+		).Replace(target), status)
+	}), nil
+}
+
+// RewriteHandler rewrites the path using the first matching rule. Replacements can
+// reference capture groups ($1) and set the query by containing a "?". Rules match the path
+// below the route pattern with a leading slash, i.e. "^/old/" matches /old/foo on route "/".
+func RewriteHandler(next http.Handler, rules []Rewrite) (http.Handler, error) {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := "/" + strings.TrimPrefix(r.URL.Path, "/")
+		for i, re := range res {
+			if !re.MatchString(path) {
+				continue
+			}
+			u := *r.URL
+			u.Path, u.RawPath = re.ReplaceAllString(path, rules[i].Replacement), ""
+			if j := strings.IndexByte(u.Path, '?'); j != -1 {
+				u.Path, u.RawQuery = u.Path[:j], u.Path[j+1:]
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL = &u
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
 }
 
+// HeaderHandler sets the provided headers - empty values delete the header.
 func HeaderHandler(next http.Handler, headers map[string]string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		for k, v := range headers {
-			w.Header().Set(k, v)
+			if v == "" {
+				w.Header().Del(k)
+			} else {
+				w.Header().Set(k, v)
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (ba *BasicAuth) Handler(next http.Handler) http.Handler {
+// DefaultHeaderHandler sets the provided headers unless the response already has them,
+// e.g. because the upstream of a proxy route set its own.
+func DefaultHeaderHandler(next http.Handler, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dw := &defaultHeaderWriter{ResponseWriter: w, headers: headers}
+		next.ServeHTTP(dw, r)
+		dw.setHeaders()
+	})
+}
+
+// HTTPSHandler redirects http requests to https (unless allowHTTP is set or the request is local)
+// and sets Strict-Transport-Security on https responses. Requests that a trusted proxy received via https
+// (X-Forwarded-Proto, see forwardedHandler) count as https.
+func HTTPSHandler(next http.Handler, port int, allowHTTP bool, hsts *HSTS) http.Handler {
+	hstsValue := ""
+	if hsts != nil {
+		maxAge := time.Duration(hsts.MaxAge)
+		if maxAge == 0 {
+			maxAge = 365 * 24 * time.Hour
+		}
+		hstsValue = fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+		if hsts.IncludeSubDomains {
+			hstsValue += "; includeSubDomains"
+		}
+		if hsts.Preload {
+			hstsValue += "; preload"
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHTTPS(r) {
+			if hstsValue != "" {
+				w.Header().Set("Strict-Transport-Security", hstsValue)
+			}
+		} else if !allowHTTP && !isLoopback(r.RemoteAddr) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(port))
+			}
+			uri := r.RequestURI
+			if u, err := url.ParseRequestURI(uri); err == nil {
+				uri = u.RequestURI()
+			}
+			http.Redirect(w, r, "https://"+host+uri, http.StatusPermanentRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ba *BasicAuth) IsSet() bool {
+	return ba.User != "" || ba.Password != "" || len(ba.Users) != 0 || ba.Htpasswd != ""
+}
+
+// Handler checks credentials against Users and Htpasswd (bcrypt or argon2id hashes) and the
+// legacy plaintext User & Password. Password may also be a hash. Successful verifications
+// are cached as hashing is slow by design.
+func (ba *BasicAuth) Handler(next http.Handler) (http.Handler, error) {
+	users, err := map[string]string{}, error(nil)
+	if ba.Htpasswd != "" {
+		if users, err = readHtpasswd(ba.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	for user, hash := range ba.Users {
+		users[user] = hash
+	}
+	isPlaintext := ba.User != "" || ba.Password != ""
+	if isPasswordHash(ba.Password) {
+		users[ba.User], isPlaintext = ba.Password, false
+	}
+	for user, hash := range users {
+		if err := checkPasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("BasicAuth %q: %w", user, err)
+		}
+	}
+	verified := sync.Map{}
 	eq := func(s1, s2 string) bool { return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1 }
+	isValid := func(user, password string) bool {
+		if isPlaintext && eq(user, ba.User) && eq(password, ba.Password) {
+			return true
+		}
+		hash, ok := users[user]
+		if !ok {
+			hash = dummyHash()
+		}
+		key := credentialsKey(user, password, hash)
+		if _, isVerified := verified.Load(key); isVerified {
+			return true
+		}
+		valid, err := verifyPassword(hash, password)
+		if err != nil {
+			log.Printf("basic auth: %s: %s", user, err)
+		} else if valid && ok {
+			verified.Store(key, true)
+		}
+		return valid && ok
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, password, ok := r.BasicAuth()
-		if !ok || !eq(user, ba.User) || !eq(password, ba.Password) {
+		if !ok || !isValid(user, password) {
 			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, ba.Realm))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 		next.ServeHTTP(w, r)
-	})
+	}), nil
 }
 
 func (fs *fs) Open(name string) (http.File, error) {
 	f, err := fs.FileSystem.Open(name)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return fs.openFallback(name, err)
+	} else if err != nil {
 		return nil, err
 	} else if s, err := f.Stat(); err != nil {
 		return nil, err
-	} else if !s.IsDir() {
+	} else if !s.IsDir() || fs.DirectoryListing {
 		return f, nil
 	} else if f2, err := fs.FileSystem.Open(filepath.Join(name, "index.html")); err != nil {
+		f.Close()
 		return nil, err
 	} else if err := f2.Close(); err != nil {
 		return nil, err
@@ -116,7 +352,23 @@ func (fs *fs) Open(name string) (http.File, error) {
 	return f, nil
 }
 
+func (fs *fs) openFallback(name string, err error) (http.File, error) {
+	ext := path.Ext(name)
+	if fs.CleanURLs && ext == "" {
+		if f, err := fs.FileSystem.Open(name + ".html"); err == nil {
+			return f, nil
+		}
+	}
+	if fs.SPAFallback != "" && (ext == "" || ext == ".html") && path.Base(name) != "index.html" {
+		return fs.FileSystem.Open("/" + strings.TrimPrefix(fs.SPAFallback, "/"))
+	}
+	return nil, err
+}
+
 func (r *responseWriter) Write(bytes []byte) (count int, err error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
 	count, err = r.ResponseWriter.Write(bytes)
 	r.count += count
 	return count, err
@@ -127,16 +379,41 @@ func (r *responseWriter) Hijack() (c net.Conn, b *bufio.ReadWriter, err error) {
 }
 
 func (r *responseWriter) WriteHeader(status int) {
-	errPath, ok := r.errPaths[status]
-	if !ok {
-		errPath = r.errPaths[0]
+	r.ResponseWriter.WriteHeader(status)
+	r.status = status
+}
+
+func (w *defaultHeaderWriter) setHeaders() {
+	if w.wroteHeader {
+		return
 	}
-	if errPath == "" {
-		r.ResponseWriter.WriteHeader(status)
-	} else {
-		http.Redirect(r.ResponseWriter, r.req, errPath, http.StatusTemporaryRedirect)
+	w.wroteHeader = true
+	for k, v := range w.headers {
+		if w.Header().Get(k) == "" {
+			w.Header().Set(k, v)
+		}
 	}
-	r.status = status
+}
+
+func (w *defaultHeaderWriter) WriteHeader(status int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *defaultHeaderWriter) Write(bs []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *defaultHeaderWriter) Flush() {
+	w.setHeaders()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *defaultHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
 func newLogFormatter(format string) (func(interface{}) string, error) {
@@ -153,6 +430,18 @@ func newLogFormatter(format string) (func(interface{}) string, error) {
 	}, err
 }
 
+// setLogUpstream records the upstream that served the request for LogHandler.
+func setLogUpstream(r *http.Request, upstream string) {
+	if li, ok := r.Context().Value(logInfoKey{}).(*logInfo); ok {
+		li.upstream = upstream
+	}
+}
+
+func isLoopback(remoteAddress string) bool {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	return err == nil && net.ParseIP(host).IsLoopback()
+}
+
 func maskIP(remoteAddress string) string {
 	host, _, err := net.SplitHostPort(remoteAddress)
 	if err != nil {
@@ -164,3 +453,8 @@ func maskIP(remoteAddress string) string {
 	}
 	return ip.Mask(ipv6Mask).String()
 }
+
+// isHTTPS reports whether the client connected via https - X-Forwarded-Proto is only kept for trusted proxies.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,512 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRateLimitHandler(t *testing.T) {
+	block, release := make(chan struct{}), make(chan struct{})
+	h, err := RateLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			block <- struct{}{}
+			<-release
+		}
+	}), RateLimit{RPS: 1, Burst: 2, Conns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	go serve("/block", "10.0.0.1:1234")
+	<-block
+	if w := serve("/", "10.0.1.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected concurrent request from same /16 to be rejected: %d", w.Code)
+	}
+	close(release)
+
+	if w := serve("/", "10.1.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("expected first request to pass: %d", w.Code)
+	} else if w := serve("/", "10.1.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("expected burst request to pass: %d", w.Code)
+	} else if w := serve("/", "10.1.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected request exceeding burst to be rejected: %d", w.Code)
+	} else if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After: 1 got %q", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, "app.js.br"), []byte("brotli"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	static, err := StaticHandler(dir, StaticOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	static = CompressHandler(PrecompressedHandler(static, dir), Compress{})
+	text := strings.Repeat("k", 2048)
+	dynamic := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("small"))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(text))
+		default:
+			w.Write([]byte(text))
+		}
+	}), Compress{})
+
+	testCompress(t, "gzip", dynamic, "/", "gzip", "gzip", text)
+	testCompress(t, "not accepted", dynamic, "/", "br;q=1, gzip;q=0", "", text)
+	testCompress(t, "too small", dynamic, "/small", "gzip", "", "small")
+	testCompress(t, "incompressible", dynamic, "/png", "gzip", "", text)
+	testCompress(t, "precompressed", static, "/app.js", "gzip, br", "br", "brotli")
+	testCompress(t, "precompressed not accepted", static, "/app.js", "gzip", "", "original")
+}
+
+func testCompress(t *testing.T, name string, h http.Handler, path, acceptEncoding, encoding, body string) {
+	t.Run(name, func(t *testing.T) {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(w, r)
+		if e := w.Header().Get("Content-Encoding"); e != encoding {
+			t.Fatalf("expected encoding %q got %q", encoding, e)
+		}
+		bs := w.Body.Bytes()
+		if encoding == "gzip" {
+			r, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			} else if bs, err = io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(bs) != body {
+			t.Fatalf("expected body %q got %q", body, string(bs))
+		}
+	})
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":        "index",
+		"about.html":        "about",
+		"assets/app.123.js": "js",
+		"files/a.txt":       "a",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	static, err := StaticHandler(dir, StaticOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, code := range map[string]int{"/about": 404, "/files/": 404, "/app/route": 404, "/about.html": 200} {
+		w := httptest.NewRecorder()
+		static.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Fatalf("%s: expected %d got %d", path, code, w.Code)
+		}
+	}
+	static, err = StaticHandler(dir, StaticOptions{
+		SPAFallback:      "index.html",
+		CleanURLs:        true,
+		DirectoryListing: true,
+		CacheControl:     map[string]string{"/": "no-cache", "/assets/": "public, max-age=31536000, immutable"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string][3]string{
+		"/about":             {"200", "about", "no-cache"},
+		"/app/route":         {"200", "index", "no-cache"},
+		"/assets/app.123.js": {"200", "js", "public, max-age=31536000, immutable"},
+		"/assets/missing.js": {"404", "", "public, max-age=31536000, immutable"},
+		"/files/":            {"200", "a.txt", "no-cache"},
+	} {
+		w := httptest.NewRecorder()
+		static.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if code := strconv.Itoa(w.Code); code != expected[0] || !strings.Contains(w.Body.String(), expected[1]) {
+			t.Fatalf("%s: expected %s %q got %s %q", path, expected[0], expected[1], code, w.Body.String())
+		} else if cc := w.Header().Get("Cache-Control"); cc != expected[2] {
+			t.Fatalf("%s: expected Cache-Control %q got %q", path, expected[2], cc)
+		}
+	}
+}
+
+func TestRedirectAndRewriteHandler(t *testing.T) {
+	redirect, err := RedirectHandler("https://example.com{path}{query}", http.StatusPermanentRedirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	redirect.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/foo?bar=baz", nil))
+	if l := w.Header().Get("Location"); w.Code != http.StatusPermanentRedirect || l != "https://example.com/foo?bar=baz" {
+		t.Fatalf("unexpected redirect: %d %q", w.Code, l)
+	}
+
+	rewrite, err := RewriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	}), []Rewrite{
+		{`^/posts/(\d+)\.html$`, "/blog?id=$1"},
+		{`^/old/`, "/new/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"/posts/42.html": "/blog?id=42",
+		"/old/foo":       "/new/foo",
+		"/other?x=1":     "/other?x=1",
+	} {
+		w := httptest.NewRecorder()
+		rewrite.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if s := w.Body.String(); s != expected {
+			t.Fatalf("expected %q to be rewritten to %q got %q", path, expected, s)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	}))
+	defer upstream.Close()
+	c := &Config{Routes: []*Route{
+		{Patterns: []string{"/"}, Target: upstream.URL, Rewrite: []Rewrite{{`^/old/(.*)$`, "/new/$1"}}},
+		{Patterns: []string{"/app/"}, Target: upstream.URL + "/app", Rewrite: []Rewrite{{`^/old/(.*)$`, "/new/$1"}}},
+	}}
+	h, _, err := c.getHandlerAndHostnames(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"/old/foo": "/new/foo", "/app/old/foo": "/app/new/foo"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if s := w.Body.String(); s != expected {
+			t.Fatalf("route: expected %q to be rewritten to %q got %q", path, expected, s)
+		}
+	}
+}
+
+func TestHeaderHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	}))
+	defer upstream.Close()
+	c := &Config{Routes: []*Route{
+		{Patterns: []string{"/"}, Target: upstream.URL, Headers: map[string]string{"referrer-policy": "no-referrer"}},
+	}}
+	h, _, err := c.getHandlerAndHostnames(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	for k, expected := range map[string][]string{
+		"Content-Security-Policy": {"default-src 'self'"},
+		"Referrer-Policy":         {"no-referrer"},
+		"X-Content-Type-Options":  {"nosniff"},
+	} {
+		if vs := w.Header().Values(k); !reflect.DeepEqual(vs, expected) {
+			t.Fatalf("%s: expected %q got %q", k, expected, vs)
+		}
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+	mu, logged := sync.Mutex{}, []map[string]string{}
+	defer func(f func(string, string, map[string]string) error) { journalLog = f }(journalLog)
+	journalLog = func(msg, priority string, kvs map[string]string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if kvs["K"] == "logtest" {
+			logged = append(logged, kvs)
+		}
+		return nil
+	}
+	c := &Config{Routes: []*Route{
+		{Patterns: []string{"/"}, Target: upstream.URL, LogStructured: true, LogFields: map[string]string{"K": "logtest"}},
+	}}
+	h, _, err := c.getHandlerAndHostnames(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/log", nil))
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logged) != 1 {
+		t.Fatalf("expected one structured log entry: %v", logged)
+	}
+	kvs := logged[0]
+	if _, err := strconv.Atoi(kvs["HTTP_DURATION_MS"]); err != nil {
+		t.Fatalf("expected HTTP_DURATION_MS: %v", kvs)
+	}
+	upstreamURL, _ := url.Parse(upstream.URL)
+	for k, expected := range map[string]string{"HTTP_URL": "log", "HTTP_STATUS": "418", "HTTP_METHOD": "GET", "HTTP_UPSTREAM": upstreamURL.Host} {
+		if kvs[k] != expected {
+			t.Fatalf("%s: expected %q got %q", k, expected, kvs[k])
+		}
+	}
+}
+
+func TestHTTPSHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := HTTPSHandler(ok, 443, false, &HSTS{IncludeSubDomains: true})
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo?bar", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	h.ServeHTTP(w, r)
+	if l := w.Header().Get("Location"); w.Code != http.StatusPermanentRedirect || l != "https://example.com/foo?bar" {
+		t.Fatalf("expected redirect to https: %d %q", w.Code, l)
+	}
+
+	w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com/", nil)
+	h.ServeHTTP(w, r)
+	if v := w.Header().Get("Strict-Transport-Security"); v != "max-age=31536000; includeSubDomains" {
+		t.Fatalf("unexpected Strict-Transport-Security: %q", v)
+	}
+
+	w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	HTTPSHandler(ok, 443, true, nil).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected http to be allowed: %d", w.Code)
+	}
+
+	trusted, _ := parseCIDRs([]string{"10.0.0.1"})
+	for remoteAddr, status := range map[string]int{"10.0.0.1:1234": http.StatusOK, "1.2.3.4:1234": http.StatusPermanentRedirect} {
+		w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-Proto", "https")
+		forwardedHandler(h, trusted).ServeHTTP(w, r)
+		if hsts := w.Header().Get("Strict-Transport-Security"); w.Code != status || (status == http.StatusOK) != (hsts != "") {
+			t.Fatalf("%s: unexpected X-Forwarded-Proto handling: %d %q", remoteAddr, w.Code, hsts)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	bcryptHash, err := HashPassword("bcrypt-password", "bcrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := HashPassword("argon2-password", "argon2id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("# comment\nfile:"+bcryptHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ba := &BasicAuth{
+		User:     "plain",
+		Password: "plain-password",
+		Users:    map[string]string{"bcrypt": bcryptHash, "argon2": argon2Hash},
+		Htpasswd: htpasswd,
+	}
+	h, err := ba.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, password string
+		status         int
+	}{
+		{"plain", "plain-password", 200},
+		{"bcrypt", "bcrypt-password", 200},
+		{"bcrypt", "bcrypt-password", 200},
+		{"argon2", "argon2-password", 200},
+		{"file", "bcrypt-password", 200},
+		{"bcrypt", "argon2-password", 401},
+		{"unknown", "bcrypt-password", 401},
+		{"plain", "", 401},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(c.user, c.password)
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s:%s: expected %d got %d", c.user, c.password, c.status, w.Code)
+		}
+	}
+
+	salt := "$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, hash := range []string{"$argon2id$v=19$m=65536,t=3,p=0" + salt, "$argon2id$v=19$m=4194304,t=3,p=4" + salt,
+		"$argon2id$v=19$m=65536,t=1000,p=4" + salt, "$2a$31$" + strings.Repeat("a", 53)} {
+		if _, err := (&BasicAuth{Users: map[string]string{"user": hash}}).Handler(h); err == nil {
+			t.Fatalf("expected error for expensive or invalid hash %q", hash)
+		}
+	}
+
+	r := &Route{Patterns: []string{"/"}, Target: "redirect:/", RateLimit: &RateLimit{RPS: 1, Burst: 1},
+		BasicAuth: BasicAuth{Users: map[string]string{"bcrypt": bcryptHash}}}
+	rh, err := r.Handler(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{401, 429} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "1.2.3.4:1234"
+		r.SetBasicAuth("bcrypt", "wrong")
+		rh.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Fatalf("expected rate limit before auth: expected %d got %d", status, w.Code)
+		}
+	}
+}
+
+func TestErrPageHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"404.html.tmpl": "{{ .status }} not found: {{ .url }} ({{ .requestId }})",
+		"403.html":      "<div id=app>{{ message }}</div>",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote " + r.Header.Get("X-Error-Status")))
+	}))
+	defer errServer.Close()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("ok"))
+		case "/fail":
+			http.Error(w, "upstream error", http.StatusBadGateway)
+		case "/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/errors/401.html":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("upstream 401 page"))
+		case "/unauthorized":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			w.Header().Set("Content-Length", "9")
+			http.NotFound(w, r)
+		}
+	})
+	static := ErrPageHandler(next, map[int]string{404: "/404.html.tmpl", 403: "403.html", 0: errServer.URL}, dir)
+	proxied := ErrPageHandler(next, map[int]string{401: "/errors/401.html", 403: "file:" + filepath.Join(dir, "403.html"),
+		404: "/errors/404.html"}, "")
+	for _, c := range []struct {
+		h          http.Handler
+		path, body string
+		code       int
+	}{
+		{static, "/ok", "ok", 200},
+		{static, "/missing", "404 not found: /missing (abc)", 404},
+		{static, "/forbidden", "<div id=app>{{ message }}</div>", 403},
+		{static, "/fail", "remote 502", 502},
+		{proxied, "/unauthorized", "upstream 401 page", 401},
+		{proxied, "/forbidden", "<div id=app>{{ message }}</div>", 403},
+		{proxied, "/missing", "404 Not Found\n", 404},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", c.path, nil)
+		r.Header.Set("X-Request-Id", "abc")
+		c.h.ServeHTTP(w, r)
+		if w.Code != c.code || w.Body.String() != c.body {
+			t.Fatalf("%s: expected %d %q got %d %q", c.path, c.code, c.body, w.Code, w.Body.String())
+		} else if strings.HasPrefix(c.body, "404 not found") && w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("%s: unexpected headers: %v", c.path, w.Header())
+		}
+	}
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	ErrPageHandler(http.NotFoundHandler(), map[int]string{404: "missing.html"}, dir).ServeHTTP(w, r)
+	if w.Code != 404 || w.Body.String() != "404 page not found\n" {
+		t.Fatalf("expected default page for missing err page: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIPFilterHandler(t *testing.T) {
+	h, err := IPFilterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		[]string{"10.0.0.0/8", "192.168.1.1"}, []string{"10.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = realIPHandler(h, cidrs{{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(32, 32)}})
+	for _, c := range []struct {
+		remoteAddr, xff, forwarded string
+		status                     int
+	}{
+		{"10.1.2.3:1234", "", "", 200},
+		{"192.168.1.1:1234", "", "", 200},
+		{"10.0.0.1:1234", "", "", 403},
+		{"8.8.8.8:1234", "", "", 403},
+		{"8.8.8.8:1234", "10.1.2.3", "", 403},
+		{"127.0.0.1:1234", "10.1.2.3", "", 200},
+		{"127.0.0.1:1234", "10.1.2.3, 8.8.8.8", "", 403},
+		{"127.0.0.1:1234", "8.8.8.8, 10.1.2.3, 127.0.0.1", "", 200},
+		{"127.0.0.1:1234", "", "for=10.1.2.3;proto=https", 200},
+		{"127.0.0.1:1234", "", `for=8.8.8.8, for="10.1.2.3:4711", for=127.0.0.1`, 200},
+		{"127.0.0.1:1234", "", `for="[2001:db8::1]:4711"`, 403},
+		{"127.0.0.1:1234", "", "for=_hidden", 403},
+		{"8.8.8.8:1234", "", "for=10.1.2.3", 403},
+		{"127.0.0.1:1234", "10.1.2.3", "for=8.8.8.8", 200},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.forwarded != "" {
+			r.Header.Set("Forwarded", c.forwarded)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s (%s %s): expected %d got %d", c.remoteAddr, c.xff, c.forwarded, c.status, w.Code)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := &metrics{routes: map[routeKey]*routeMetrics{}}
+	h, err := LogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), "", nil, false, m.observer("app", "example.com/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, l := range []string{
+		`k_http_requests_total{app="app",route="example.com/",code="200"} 2`,
+		`k_http_request_duration_seconds_count{app="app",route="example.com/"} 2`,
+		`k_http_request_duration_seconds_bucket{app="app",route="example.com/",le="+Inf"} 2`,
+		`k_http_response_bytes_total{app="app",route="example.com/"} 10`,
+	} {
+		if !strings.Contains(w.Body.String(), l+"\n") {
+			t.Fatalf("expected metrics to contain %q:\n%s", l, w.Body.String())
+		}
+	}
+}
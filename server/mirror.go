@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type Mirror struct {
+	Target      string
+	MaxBodySize int64
+	Timeout     Duration
+	MaxInFlight int
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// MirrorHandler sends a copy of each request to Target in the background and discards the response.
+// Requests with bodies larger than MaxBodySize are not mirrored. Mirror failures and status codes
+// that differ from the primary response are logged.
+func MirrorHandler(next http.Handler, m Mirror, fields map[string]string) (http.Handler, error) {
+	p, err := ProxyHandler([]string{m.Target}, "")
+	if err != nil {
+		return nil, err
+	}
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = 1 << 20
+	}
+	if m.Timeout == 0 {
+		m.Timeout = Duration(10 * time.Second)
+	}
+	if m.MaxInFlight == 0 {
+		m.MaxInFlight = 100
+	}
+	us, inFlight := p.upstreams[0], make(chan struct{}, m.MaxInFlight)
+	transport := us.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.ContentLength > m.MaxBodySize {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := []byte(nil)
+		if r.Body != nil && r.Body != http.NoBody {
+			bs, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBodySize+1))
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(bs), r.Body), r.Body}
+			if err != nil || int64(len(bs)) > m.MaxBodySize {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body = bs
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout))
+		mr, status, req := r.Clone(ctx), make(chan int, 1), fmt.Sprintf("%s %s%s", r.Method, r.Host, r.URL)
+		mr.URL.Scheme, mr.URL.Host, mr.RequestURI = us.Scheme, us.URL.Host, ""
+		mr.URL.Path, mr.URL.RawPath = us.URL.Path+r.URL.Path, ""
+		mr.Body, mr.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		for _, k := range hopHeaders {
+			mr.Header.Del(k)
+		}
+		go func() {
+			defer func() { <-inFlight }()
+			defer cancel()
+			res, err := transport.RoundTrip(mr)
+			if err != nil {
+				logJournal(fmt.Sprintf("mirror %s: %s: %s", us.name, req, err), "4", fields)
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			select {
+			case s := <-status:
+				if s != res.StatusCode {
+					msg := fmt.Sprintf("mirror %s: %s: status %d, primary %d", us.name, req, res.StatusCode, s)
+					logJournal(msg, "4", fields)
+				}
+			case <-ctx.Done():
+			}
+		}()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		status <- rw.status
+	}), nil
+}
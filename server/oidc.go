@@ -0,0 +1,393 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDC struct {
+	Issuer, ClientID, ClientSecret string
+	Emails, Domains                []string
+	Header                         string
+}
+
+type oidc struct {
+	OIDC
+	key []byte
+	sync.Mutex
+	provider *oidcProvider
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  map[string]crypto.PublicKey
+	fetched               time.Time
+}
+
+type oidcSession struct {
+	Email   string
+	Expires int64
+}
+
+type oidcState struct {
+	State, Nonce, URL string
+	Expires           int64
+}
+
+var oidcSessionDuration, oidcProviderTTL = 24 * time.Hour, 1 * time.Hour
+var oidcCallbackPath = "_oidc/callback"
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// OIDCHandler gates the route behind an OpenID Connect authorization code flow. Authenticated users
+// get a signed session cookie and their email is passed upstream in the configured header.
+func OIDCHandler(next http.Handler, c OIDC) (http.Handler, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return nil, fmt.Errorf("OIDC requires Issuer, ClientID and ClientSecret")
+	} else if len(c.Emails) == 0 && len(c.Domains) == 0 {
+		return nil, fmt.Errorf("OIDC requires allowed Emails or Domains")
+	} else if c.Header == "" {
+		c.Header = "X-Forwarded-User"
+	}
+	mac := hmac.New(sha256.New, []byte(c.ClientSecret))
+	mac.Write([]byte("k-oidc-session\x00" + c.Issuer + "\x00" + c.ClientID))
+	o := &oidc{OIDC: c, key: mac.Sum(nil)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(o.Header)
+		if strings.HasSuffix(r.URL.Path, oidcCallbackPath) {
+			o.callback(w, r)
+		} else if s := (&oidcSession{}); o.readCookie(r, "_k_oidc", s) && s.Expires > time.Now().Unix() {
+			// the session cookie is shared by all routes of the host - it might have been issued for another allow list
+			if !o.isAllowed(s.Email, nil) {
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			r.Header.Set(o.Header, s.Email)
+			next.ServeHTTP(w, r)
+		} else {
+			o.login(w, r)
+		}
+	}), nil
+}
+
+func (o *oidc) login(w http.ResponseWriter, r *http.Request) {
+	p, err := o.discover()
+	if err != nil {
+		log.Printf("oidc: discovery failed: %s", err)
+		http.Error(w, "502 bad gateway", http.StatusBadGateway)
+		return
+	}
+	s := &oidcState{State: randomHex(16), Nonce: randomHex(16), URL: r.RequestURI,
+		Expires: time.Now().Add(10 * time.Minute).Unix()}
+	o.writeCookie(w, r, "_k_oidc_state", s, 600)
+	http.Redirect(w, r, p.AuthorizationEndpoint+"?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.ClientID},
+		"redirect_uri":  {o.callbackURL(r)},
+		"scope":         {"openid email"},
+		"state":         {s.State},
+		"nonce":         {s.Nonce},
+	}.Encode(), http.StatusFound)
+}
+
+func (o *oidc) callback(w http.ResponseWriter, r *http.Request) {
+	s, q := &oidcState{}, r.URL.Query()
+	if !o.readCookie(r, "_k_oidc_state", s) || s.Expires < time.Now().Unix() || q.Get("state") != s.State {
+		http.Error(w, "400 bad request: invalid state", http.StatusBadRequest)
+		return
+	} else if err := q.Get("error"); err != "" {
+		http.Error(w, "401 unauthorized: "+err, http.StatusUnauthorized)
+		return
+	}
+	claims, err := o.exchange(r, q.Get("code"), s.Nonce)
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return
+	} else if !o.isAllowed(claims.Email, claims.EmailVerified) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+	o.writeCookie(w, r, "_k_oidc", &oidcSession{claims.Email, time.Now().Add(oidcSessionDuration).Unix()},
+		int(oidcSessionDuration.Seconds()))
+	o.writeCookie(w, r, "_k_oidc_state", nil, -1)
+	u, err := url.ParseRequestURI(s.URL)
+	if err != nil || u.Host != "" {
+		u = &url.URL{Path: "/"}
+	}
+	http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+}
+
+func (o *oidc) exchange(r *http.Request, code, nonce string) (*idTokenClaims, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.callbackURL(r)},
+	}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	v := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	} else if res.StatusCode != http.StatusOK || v.IDToken == "" {
+		return nil, fmt.Errorf("token response: status %d", res.StatusCode)
+	}
+	claims, err := p.verify(v.IDToken)
+	if err != nil {
+		return nil, err
+	} else if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("id token: bad issuer %q", claims.Issuer)
+	} else if !claims.Audience.contains(o.ClientID) {
+		return nil, fmt.Errorf("id token: bad audience %q", claims.Audience)
+	} else if claims.Expires < time.Now().Unix() {
+		return nil, fmt.Errorf("id token: expired")
+	} else if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token: bad nonce")
+	}
+	return claims, nil
+}
+
+func (o *oidc) isAllowed(email string, verified *bool) bool {
+	if email == "" || (verified != nil && !*verified) {
+		return false
+	}
+	for _, e := range o.Emails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for _, d := range o.Domains {
+		if strings.EqualFold(strings.TrimPrefix(d, "@"), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *oidc) discover() (*oidcProvider, error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.provider != nil && time.Since(o.provider.fetched) < oidcProviderTTL {
+		return o.provider, nil
+	}
+	p := &oidcProvider{}
+	if err := getJSON(strings.TrimSuffix(o.Issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	} else if p.Issuer != o.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %q != %q", p.Issuer, o.Issuer)
+	}
+	jwks := struct{ Keys []jwk }{}
+	if err := getJSON(p.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys, p.fetched = map[string]crypto.PublicKey{}, time.Now()
+	for _, k := range jwks.Keys {
+		if pub, err := k.publicKey(); err != nil {
+			log.Printf("oidc: skipping key %q: %s", k.Kid, err)
+		} else {
+			p.keys[k.Kid] = pub
+		}
+	}
+	o.provider = p
+	return p, nil
+}
+
+func (o *oidc) callbackURL(r *http.Request) string {
+	scheme, prefix := "http", "/"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		prefix = strings.TrimSuffix(u.Path, strings.TrimPrefix(r.URL.Path, "/"))
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(prefix, oidcCallbackPath) + oidcCallbackPath
+}
+
+func (o *oidc) writeCookie(w http.ResponseWriter, r *http.Request, name string, v interface{}, maxAge int) {
+	bs, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(bs)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + o.sign(payload),
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (o *oidc) readCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(o.sign(parts[0])), []byte(parts[1])) {
+		return false
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Unmarshal(bs, v) == nil
+}
+
+func (o *oidc) sign(payload string) string {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Audience      audience `json:"aud"`
+	Expires       int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+}
+
+type audience []string
+
+type jwk struct {
+	Kid, Kty, Crv, N, E, X, Y string
+}
+
+func (p *oidcProvider) verify(token string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("id token: malformed")
+	}
+	header := struct{ Alg, Kid string }{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := p.keys[header.Kid].(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return nil, fmt.Errorf("id token: invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		r, s := new(big.Int).SetBytes(sig[:len(sig)/2]), new(big.Int).SetBytes(sig[len(sig)/2:])
+		if header.Alg != "ES256" || len(sig) != 64 || !ecdsa.Verify(pub, hash[:], r, s) {
+			return nil, fmt.Errorf("id token: invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("id token: unknown key %q", header.Kid)
+	}
+	claims := &idTokenClaims{}
+	return claims, decodeSegment(parts[1], claims)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (a *audience) UnmarshalJSON(bs []byte) error {
+	if len(bs) != 0 && bs[0] == '"' {
+		s := ""
+		err := json.Unmarshal(bs, &s)
+		*a = audience{s}
+		return err
+	}
+	return json.Unmarshal(bs, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(s string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func getJSON(url string, v interface{}) error {
+	res, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func randomHex(n int) string {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
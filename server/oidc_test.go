@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOIDCHandler(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := oidcIssuer(t, key, "user@example.com")
+	defer issuer.Close()
+
+	testOIDC(t, "allowed domain", issuer.URL, OIDC{Domains: []string{"example.com"}}, 200, "user@example.com")
+	testOIDC(t, "allowed email", issuer.URL, OIDC{Emails: []string{"user@example.com"}}, 200, "user@example.com")
+	testOIDC(t, "forbidden", issuer.URL, OIDC{Emails: []string{"other@example.com"}}, 403, "403 forbidden\n")
+
+	t.Run("session of other route", func(t *testing.T) {
+		mux := http.NewServeMux()
+		for prefix, email := range map[string]string{"/a/": "user@example.com", "/b/": "other@example.com"} {
+			h, err := OIDCHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+			}), OIDC{Issuer: issuer.URL, ClientID: "client", ClientSecret: "secret", Emails: []string{email}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux.Handle(prefix, http.StripPrefix(prefix, h))
+		}
+		app := httptest.NewServer(mux)
+		defer app.Close()
+		jar, _ := cookiejar.New(nil)
+		c := &http.Client{Jar: jar}
+		for path, status := range map[string]int{"/a/foo": 200, "/b/foo": 403} {
+			res, err := c.Get(app.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != status {
+				t.Fatalf("%s: expected %d got %d", path, status, res.StatusCode)
+			}
+		}
+	})
+}
+
+func testOIDC(t *testing.T, name, issuer string, c OIDC, status int, body string) {
+	t.Run(name, func(t *testing.T) {
+		c.Issuer, c.ClientID, c.ClientSecret = issuer, "client", "secret"
+		h, err := OIDCHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+		}), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := httptest.NewServer(http.StripPrefix("/", h))
+		defer app.Close()
+		jar, _ := cookiejar.New(nil)
+		res, err := (&http.Client{Jar: jar}).Get(app.URL + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		bs, _ := io.ReadAll(res.Body)
+		if res.StatusCode != status || string(bs) != body {
+			t.Fatalf("expected %d %q got %d %q", status, body, res.StatusCode, string(bs))
+		} else if status == 200 && res.Request.URL.Path != "/foo" {
+			t.Fatalf("expected redirect back to /foo got %s", res.Request.URL)
+		}
+	})
+}
+
+// oidcIssuer is a minimal stand-in OpenID provider that logs in email without asking.
+func oidcIssuer(t *testing.T, key *rsa.PrivateKey, email string) *httptest.Server {
+	mux, nonces := http.NewServeMux(), map[string]string{}
+	s := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key", "kty": "RSA",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomHex(8)
+		nonces[code] = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{
+			"code": {code}, "state": {q.Get("state")},
+		}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		nonce, ok := nonces[r.FormValue("code")]
+		if !ok {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signJWT(t, key, map[string]interface{}{
+			"iss": s.URL, "aud": "client", "exp": time.Now().Add(time.Minute).Unix(),
+			"nonce": nonce, "email": email, "email_verified": true,
+		})})
+	})
+	return s
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key"})
+	payload, _ := json.Marshal(claims)
+	s := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s.%s", s, base64.RawURLEncoding.EncodeToString(sig))
+}
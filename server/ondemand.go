@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/niklasfasching/k/util"
+)
+
+type OnDemand struct {
+	Unit         string
+	IdleTimeout  Duration
+	StartTimeout Duration
+}
+
+type onDemand struct {
+	OnDemand
+	*onDemandUnit
+	proxy  *Proxy
+	fields map[string]string
+}
+
+// onDemandUnit is shared by all routes of a unit (and kept across reloads) - a unit must only be
+// stopped once none of its routes has seen requests for IdleTimeout.
+type onDemandUnit struct {
+	sync.Mutex
+	running  bool
+	active   int64
+	lastSeen time.Time
+}
+
+var onDemandUnits = struct {
+	sync.Mutex
+	m map[string]*onDemandUnit
+}{m: map[string]*onDemandUnit{}}
+
+var startUnit, stopUnit = util.StartUnit, util.StopUnit
+
+// OnDemandHandler starts Unit on the first request and waits for an upstream of p to accept
+// connections before passing the request on. Unit is stopped after IdleTimeout without requests
+// to any of the routes using it.
+func OnDemandHandler(ctx context.Context, p *Proxy, o OnDemand, fields map[string]string) (http.Handler, error) {
+	if o.Unit == "" {
+		return nil, fmt.Errorf("OnDemand requires a Unit")
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = Duration(15 * time.Minute)
+	}
+	if o.StartTimeout == 0 {
+		o.StartTimeout = Duration(30 * time.Second)
+	}
+	onDemandUnits.Lock()
+	u, ok := onDemandUnits.m[o.Unit]
+	if !ok {
+		u = &onDemandUnit{}
+		onDemandUnits.m[o.Unit] = u
+	}
+	onDemandUnits.Unlock()
+	od := &onDemand{OnDemand: o, onDemandUnit: u, proxy: p, fields: fields}
+	p.dialFailed = od.stopped
+	go od.stopWhenIdle(ctx)
+	return od, nil
+}
+
+func (od *onDemand) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&od.active, 1)
+	defer func() {
+		od.Lock()
+		od.lastSeen = time.Now()
+		od.Unlock()
+		atomic.AddInt64(&od.active, -1)
+	}()
+	if err := od.start(r.Context()); err != nil {
+		logJournal(fmt.Sprintf("failed to start %s: %s", od.Unit, err), "3", od.fields)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	od.proxy.ServeHTTP(w, r)
+}
+
+func (od *onDemand) start(ctx context.Context) error {
+	od.Lock()
+	defer od.Unlock()
+	if od.running {
+		return nil
+	}
+	logJournal(fmt.Sprintf("starting %s", od.Unit), "5", od.fields)
+	if err := startUnit(od.Unit); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(od.StartTimeout))
+	defer cancel()
+	for {
+		if od.proxy.dialAny(ctx) {
+			od.running = true
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no upstream accepted connections: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stopped marks the unit as not running after it was stopped outside of k-http (e.g. crashed),
+// so the next request starts it again.
+func (od *onDemand) stopped() {
+	od.Lock()
+	defer od.Unlock()
+	if od.running {
+		logJournal(fmt.Sprintf("%s is not accepting connections", od.Unit), "4", od.fields)
+		od.running = false
+	}
+}
+
+// stopWhenIdle also takes care of units started or stopped outside of k-http, e.g. before a restart.
+func (od *onDemand) stopWhenIdle(ctx context.Context) {
+	running := od.proxy.dialAny(ctx)
+	od.Lock()
+	od.running, od.lastSeen = od.running || running, time.Now()
+	od.Unlock()
+	t := time.NewTicker(time.Duration(od.IdleTimeout) / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !od.proxy.dialAny(ctx) {
+			od.stopped()
+		}
+		od.Lock()
+		if od.running && atomic.LoadInt64(&od.active) == 0 && time.Since(od.lastSeen) > time.Duration(od.IdleTimeout) {
+			logJournal(fmt.Sprintf("stopping idle %s", od.Unit), "5", od.fields)
+			if err := stopUnit(od.Unit); err != nil {
+				logJournal(fmt.Sprintf("failed to stop %s: %s", od.Unit, err), "3", od.fields)
+			} else {
+				od.running = false
+			}
+		}
+		od.Unlock()
+	}
+}
+
+// dialAny reports whether any upstream accepts connections.
+func (p *Proxy) dialAny(ctx context.Context) bool {
+	for _, us := range p.upstreams {
+		dial := (&net.Dialer{}).DialContext
+		if t, ok := us.Transport.(*http.Transport); ok && t.DialContext != nil {
+			dial = t.DialContext
+		}
+		host := us.Host
+		if us.Port() == "" && us.Scheme == "https" {
+			host += ":443"
+		} else if us.Port() == "" {
+			host += ":80"
+		}
+		if c, err := dial(ctx, "tcp", host); err == nil {
+			c.Close()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Passthrough forwards TLS connections for Hostnames (matched on SNI, *.example.com matches
+// one label) to Target (host:port or unix:/path) without terminating TLS.
+type Passthrough struct {
+	Hostnames []string
+	Target    string
+	LogFields map[string]string
+}
+
+type passthroughs map[string]*Passthrough
+
+type sniListener struct {
+	net.Listener
+	lookup func(serverName string) *Passthrough
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+type readOnlyConn struct{ r io.Reader }
+
+var errServerNamePeeked = errors.New("server name peeked")
+
+var sniTimeout = 10 * time.Second
+
+func newPassthroughs(ps []*Passthrough) (passthroughs, error) {
+	m := passthroughs{}
+	for _, p := range ps {
+		if p.Target == "" {
+			return nil, fmt.Errorf("passthrough %v: Target must not be empty", p.Hostnames)
+		}
+		for _, h := range p.Hostnames {
+			h = strings.ToLower(h)
+			if _, ok := m[h]; ok {
+				return nil, fmt.Errorf("passthrough: duplicate hostname %q", h)
+			}
+			m[h] = p
+		}
+	}
+	return m, nil
+}
+
+func (ps passthroughs) match(serverName string) *Passthrough {
+	serverName = strings.ToLower(serverName)
+	if p, ok := ps[serverName]; ok {
+		return p
+	}
+	return ps[wildcard(serverName)]
+}
+
+// newSNIListener peeks at the ClientHello of accepted connections and forwards those for
+// passthrough hostnames. All others are returned from Accept with the peeked bytes intact.
+func newSNIListener(l net.Listener, lookup func(serverName string) *Passthrough) net.Listener {
+	sl := &sniListener{
+		Listener: l,
+		lookup:   lookup,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go l.route(c)
+	}
+}
+
+func (l *sniListener) route(c net.Conn) {
+	b := &bytes.Buffer{}
+	c.SetReadDeadline(time.Now().Add(sniTimeout))
+	serverName := peekServerName(io.TeeReader(c, b))
+	c.SetReadDeadline(time.Time{})
+	pc := &peekedConn{c, io.MultiReader(b, c)}
+	if p := l.lookup(serverName); p != nil {
+		forward(pc, serverName, p)
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func forward(c net.Conn, serverName string, p *Passthrough) {
+	defer c.Close()
+	network, address := "tcp", p.Target
+	if strings.HasPrefix(p.Target, "unix:") {
+		network, address = "unix", strings.TrimPrefix(p.Target, "unix:")
+	}
+	start := time.Now()
+	u, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		logJournal(fmt.Sprintf("passthrough %s: %s", serverName, err), "4", p.LogFields)
+		return
+	}
+	defer u.Close()
+	in, out := int64(0), int64(0)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		in, _ = io.Copy(u, c)
+		closeWrite(u)
+	}()
+	out, _ = io.Copy(c, u)
+	closeWrite(c)
+	wg.Wait()
+	msg := fmt.Sprintf("passthrough %s %s -> %s: %d/%d bytes in %s",
+		maskIP(c.RemoteAddr().String()), serverName, p.Target, in, out, time.Since(start).Round(time.Millisecond))
+	logJournal(msg, "6", p.LogFields)
+}
+
+// peekServerName lets crypto/tls parse the ClientHello and aborts the handshake afterwards.
+func peekServerName(r io.Reader) string {
+	serverName := ""
+	tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errServerNamePeeked
+		},
+	}).Handshake()
+	return serverName
+}
+
+func closeWrite(c net.Conn) {
+	if pc, ok := c.(*peekedConn); ok {
+		c = pc.Conn
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+func (c *peekedConn) Read(bs []byte) (int, error) { return c.r.Read(bs) }
+
+func (c readOnlyConn) Read(bs []byte) (int, error)        { return c.r.Read(bs) }
+func (c readOnlyConn) Write(bs []byte) (int, error)       { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
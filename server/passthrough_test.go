@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassthrough(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	}))
+	defer backend.Close()
+	ps, err := newPassthroughs([]*Passthrough{{
+		Hostnames: []string{"db.example.com", "*.mqtt.example.com"},
+		Target:    strings.TrimPrefix(backend.URL, "https://"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "local")
+	}))
+	local.Listener.Close()
+	local.Listener = newSNIListener(l, ps.match)
+	local.StartTLS()
+	defer local.Close()
+
+	for serverName, expected := range map[string]string{
+		"db.example.com":       "backend",
+		"a.mqtt.example.com":   "backend",
+		"a.b.mqtt.example.com": "local",
+		"www.example.com":      "local",
+		"":                     "local",
+	} {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		res, err := c.Get(local.URL)
+		if err != nil {
+			t.Fatalf("%q: %s", serverName, err)
+		}
+		bs, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(bs) != expected {
+			t.Fatalf("%q: expected %q got %q", serverName, expected, string(bs))
+		}
+	}
+	if _, err := newPassthroughs([]*Passthrough{{Hostnames: []string{"a"}, Target: "x:1"}, {Hostnames: []string{"A"}, Target: "y:1"}}); err == nil {
+		t.Fatal("expected error for duplicate hostname")
+	}
+}
+
+func TestPassthroughOnly(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	}))
+	defer backend.Close()
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	c := &Config{HTTP: ports[0], HTTPS: ports[1], LetsEncryptCachePath: t.TempDir(), Passthrough: []*Passthrough{{
+		Hostnames: []string{"db.example.com"},
+		Target:    strings.TrimPrefix(backend.URL, "https://"),
+	}}}
+	go c.Start()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true},
+	}}
+	for i := 0; ; i++ {
+		res, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d", ports[1]))
+		if err != nil && i < 50 {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		} else if err != nil {
+			t.Fatalf("expected https listener for passthroughs: %s", err)
+		}
+		bs, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(bs) != "backend" {
+			t.Fatalf("expected passthrough to backend got %q", string(bs))
+		}
+		return
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type argon2Params struct {
+	time, memory uint32
+	threads      uint8
+}
+
+var defaultArgon2Params = argon2Params{time: 3, memory: 64 * 1024, threads: 4}
+
+// maxArgon2Params and maxBcryptCost bound the cost of a single verification, verifications bounds
+// how many run at once - otherwise wrong passwords for a known user are an easy way to exhaust cpu and memory.
+var maxArgon2Params, maxBcryptCost = argon2Params{time: 10, memory: 256 * 1024, threads: 16}, 14
+var verifications = make(chan struct{}, 4)
+
+// dummyHash is verified against for unknown users so they take as long as known ones.
+var dummyHash = func() func() string {
+	once, hash := sync.Once{}, ""
+	return func() string {
+		once.Do(func() { hash, _ = HashPassword("", "bcrypt") })
+		return hash
+	}
+}()
+
+// HashPassword hashes password with bcrypt (htpasswd compatible) or argon2id.
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case "", "bcrypt":
+		bs, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(bs), err
+	case "argon2id":
+		salt, p := make([]byte, 16), defaultArgon2Params
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, 32)
+		b64 := base64.RawStdEncoding.EncodeToString
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.memory, p.time, p.threads, b64(salt), b64(key)), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+func isPasswordHash(s string) bool {
+	return isBcrypt(s) || strings.HasPrefix(s, "$argon2id$")
+}
+
+func isBcrypt(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+func verifyPassword(hash, password string) (bool, error) {
+	if err := checkPasswordHash(hash); err != nil {
+		return false, err
+	}
+	verifications <- struct{}{}
+	defer func() { <-verifications }()
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	p, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	key2 := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, key2) == 1, nil
+}
+
+// checkPasswordHash rejects malformed hashes and hashes that are too expensive to verify.
+func checkPasswordHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		if cost, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return err
+		} else if cost > maxBcryptCost {
+			return fmt.Errorf("bcrypt cost %d exceeds %d", cost, maxBcryptCost)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, _, _, err := parseArgon2Hash(hash)
+		return err
+	}
+	return fmt.Errorf("unsupported hash format")
+}
+
+func parseArgon2Hash(hash string) (p argon2Params, salt, key []byte, err error) {
+	parts, version, max := strings.Split(hash, "$"), 0, maxArgon2Params
+	if len(parts) != 6 {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash")
+	} else if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id params: %w", err)
+	} else if p.time < 1 || p.time > max.time || p.threads < 1 || p.threads > max.threads ||
+		p.memory < 8*uint32(p.threads) || p.memory > max.memory {
+		return p, nil, nil, fmt.Errorf("argon2id params out of range: %q (max m=%d,t=%d,p=%d)",
+			parts[3], max.memory, max.time, max.threads)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, err
+	} else if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, err
+	} else if len(key) < 16 || len(key) > 64 {
+		return p, nil, nil, fmt.Errorf("malformed argon2id key length %d", len(key))
+	}
+	return p, salt, key, nil
+}
+
+// readHtpasswd reads user:hash lines. Only bcrypt and argon2id hashes are supported.
+func readHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, s := map[string]string{}, bufio.NewScanner(f)
+	for i := 1; s.Scan(); i++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i)
+		}
+		users[kv[0]] = kv[1]
+	}
+	return users, s.Err()
+}
+
+func credentialsKey(user, password, hash string) [32]byte {
+	return sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type upstream struct {
+	*url.URL
+	*httputil.ReverseProxy
+	name      string
+	id        string
+	weight    int
+	statuses  map[int]int
+	conns     int64
+	failures  int
+	downUntil time.Time
+	unhealthy bool
+}
+
+type Proxy struct {
+	sync.Mutex
+	strategy    string
+	upstreams   []*upstream
+	next        int
+	errPage     string
+	split       *Split
+	rewriteHost bool
+	dialFailed  func()
+}
+
+type HealthCheck struct {
+	Path              string
+	Interval, Timeout Duration
+	Status            int
+	ErrPage           string
+}
+
+// Split distributes requests across the targets by weight, e.g. [95, 5]. With Cookie set clients
+// stick to their upstream as long as its weight is not 0. Status counts per upstream are logged
+// every ReportInterval.
+// Split distributes requests by Weights. CanaryFile (written by k canary) contains a percentage
+// that overrides the weights of 2 targets - it is read when the config is (re)loaded.
+type Split struct {
+	Weights        []int
+	Cookie         string
+	ReportInterval Duration
+	CanaryFile     string
+}
+
+// BlueGreen proxies to the target of the color in ColorFile - blue if it does not exist yet.
+// The file is read when the config is (re)loaded.
+type BlueGreen struct {
+	ColorFile string
+	Targets   map[string]string
+}
+
+var minBackoff, maxBackoff = 1 * time.Second, 1 * time.Minute
+
+var strategies = map[string]bool{"": true, "round-robin": true, "least-connections": true, "ip-hash": true}
+
+// ProxyHandler proxies to http:// targets or to unix domain sockets, e.g. unix:/run/app/http.sock.
+func ProxyHandler(uris []string, strategy string) (*Proxy, error) {
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("proxy requires at least one target")
+	} else if !strategies[strategy] {
+		return nil, fmt.Errorf("unknown balance strategy %q", strategy)
+	}
+	p := &Proxy{strategy: strategy}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "unix" {
+			p.upstreams = append(p.upstreams, p.newUpstream(u, u.Host, nil))
+			continue
+		} else if u.Path == "" {
+			return nil, fmt.Errorf("unix target requires a socket path: %q", uri)
+		}
+		socket, t := u.Path, http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		p.upstreams = append(p.upstreams, p.newUpstream(&url.URL{Scheme: "http", Host: "localhost"}, socket, t))
+	}
+	return p, nil
+}
+
+func (p *Proxy) newUpstream(u *url.URL, name string, t http.RoundTripper) *upstream {
+	us := &upstream{URL: u, ReverseProxy: httputil.NewSingleHostReverseProxy(u), name: name}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	us.Transport, us.id, us.statuses = t, fmt.Sprintf("%x", h.Sum32()), map[int]int{}
+	director := us.Director
+	us.Director = func(r *http.Request) {
+		host := r.Host
+		director(r)
+		if r.Header.Get("X-Forwarded-Host") == "" {
+			r.Header.Set("X-Forwarded-Host", host)
+		}
+		if r.Header.Get("X-Forwarded-Proto") == "" {
+			proto := "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if p.rewriteHost {
+			r.Host = u.Host
+		}
+	}
+	us.ModifyResponse = func(res *http.Response) error {
+		p.mark(us, nil)
+		p.count(us, res.StatusCode)
+		return nil
+	}
+	us.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		p.mark(us, err)
+		p.count(us, http.StatusBadGateway)
+		if opErr := (*net.OpError)(nil); p.dialFailed != nil && errors.As(err, &opErr) && opErr.Op == "dial" {
+			p.dialFailed()
+		}
+		log.Printf("http: proxy error: %s: %s", name, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return us
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	us := p.pick(r)
+	if us == nil {
+		p.serveErrPage(w)
+		return
+	}
+	setLogUpstream(r, us.name)
+	if p.split != nil && p.split.Cookie != "" {
+		if c, err := r.Cookie(p.split.Cookie); err != nil || c.Value != us.id {
+			http.SetCookie(w, &http.Cookie{Name: p.split.Cookie, Value: us.id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+	}
+	atomic.AddInt64(&us.conns, 1)
+	defer atomic.AddInt64(&us.conns, -1)
+	us.ServeHTTP(w, r)
+}
+
+// HealthCheck probes all upstreams in the background until ctx is done.
+// Unhealthy upstreams are skipped - if none are left we serve the ErrPage.
+func (p *Proxy) HealthCheck(ctx context.Context, hc HealthCheck, fields map[string]string) {
+	hc = hc.withDefaults()
+	p.errPage = hc.ErrPage
+	for _, us := range p.upstreams {
+		go p.probe(ctx, us, hc, fields)
+	}
+}
+
+// Split enables weighted balancing. Weights are in the order of the targets.
+func (p *Proxy) Split(ctx context.Context, s Split, fields map[string]string) error {
+	if len(s.Weights) != len(p.upstreams) {
+		return fmt.Errorf("expected %d weights got %d", len(p.upstreams), len(s.Weights))
+	}
+	weights, err := s.ActiveWeights()
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(weights, s.Weights) {
+		logJournal(fmt.Sprintf("canary: active weights %v differ from configured weights %v", weights, s.Weights), "5", fields)
+	}
+	for i, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("weight must not be negative: %d", w)
+		}
+		p.upstreams[i].weight = w
+	}
+	if s.ReportInterval == 0 {
+		s.ReportInterval = Duration(time.Minute)
+	}
+	p.split = &s
+	go p.report(ctx, time.Duration(s.ReportInterval), fields)
+	return nil
+}
+
+func (p *Proxy) report(ctx context.Context, interval time.Duration, fields map[string]string) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		p.Lock()
+		msgs := []string{}
+		for _, us := range p.upstreams {
+			if len(us.statuses) == 0 {
+				continue
+			}
+			codes := []int{}
+			for code := range us.statuses {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			msg := fmt.Sprintf("upstream %s (weight %d):", us.name, us.weight)
+			for _, code := range codes {
+				msg += fmt.Sprintf(" %d=%d", code, us.statuses[code])
+			}
+			msgs, us.statuses = append(msgs, msg), map[int]int{}
+		}
+		p.Unlock()
+		for _, msg := range msgs {
+			logJournal(msg, "6", fields)
+		}
+	}
+}
+
+func (p *Proxy) count(us *upstream, status int) {
+	if p.split == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	us.statuses[status]++
+}
+
+// WaitHealthy probes target until it passes the health check or ctx is done.
+func WaitHealthy(ctx context.Context, target string, hc HealthCheck) error {
+	p, err := ProxyHandler([]string{target}, "")
+	if err != nil {
+		return err
+	}
+	hc = hc.withDefaults()
+	for {
+		err := p.upstreams[0].check(hc)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s is not healthy: %w", target, err)
+		case <-time.After(time.Duration(hc.Interval)):
+		}
+	}
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval == 0 {
+		hc.Interval = Duration(10 * time.Second)
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = Duration(2 * time.Second)
+	}
+	if hc.Status == 0 {
+		hc.Status = http.StatusOK
+	}
+	return hc
+}
+
+func (us *upstream) check(hc HealthCheck) error {
+	c, u := &http.Client{Timeout: time.Duration(hc.Timeout), Transport: us.Transport}, *us.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(hc.Path, "/")
+	if res, err := c.Get(u.String()); err != nil {
+		return err
+	} else if res.Body.Close(); res.StatusCode != hc.Status {
+		return fmt.Errorf("expected status %d got %d", hc.Status, res.StatusCode)
+	}
+	return nil
+}
+
+func (p *Proxy) probe(ctx context.Context, us *upstream, hc HealthCheck, fields map[string]string) {
+	t := time.NewTicker(time.Duration(hc.Interval))
+	defer t.Stop()
+	for {
+		err := us.check(hc)
+		if ctx.Err() != nil {
+			return
+		}
+		p.Lock()
+		changed := us.unhealthy != (err != nil)
+		us.unhealthy = err != nil
+		p.Unlock()
+		if changed && err != nil {
+			logJournal(fmt.Sprintf("upstream %s is unhealthy: %s", us.name, err), "4", fields)
+		} else if changed {
+			logJournal(fmt.Sprintf("upstream %s is healthy again", us.name), "5", fields)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *Proxy) serveErrPage(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "10")
+	if p.errPage == "" {
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+	} else if bs, err := os.ReadFile(p.errPage); err != nil {
+		log.Printf("http: failed to read error page: %s", err)
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(bs)
+	}
+}
+
+// pick returns the next upstream according to the strategy. Upstreams that are marked down
+// are skipped - if all of them are down we try the one that is due to come back first.
+// Upstreams failing the active health check are never picked.
+func (p *Proxy) pick(r *http.Request) *upstream {
+	p.Lock()
+	defer p.Unlock()
+	now, healthy, available := time.Now(), []*upstream{}, []*upstream{}
+	for _, us := range p.upstreams {
+		if us.unhealthy {
+			continue
+		}
+		healthy = append(healthy, us)
+		if !now.Before(us.downUntil) {
+			available = append(available, us)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	} else if len(available) == 0 {
+		next := healthy[0]
+		for _, us := range healthy[1:] {
+			if us.downUntil.Before(next.downUntil) {
+				next = us
+			}
+		}
+		return next
+	}
+	if p.split != nil {
+		if us := p.pickWeighted(r, available); us != nil {
+			return us
+		}
+	}
+	switch p.strategy {
+	case "least-connections":
+		next := available[0]
+		for _, us := range available[1:] {
+			if atomic.LoadInt64(&us.conns) < atomic.LoadInt64(&next.conns) {
+				next = us
+			}
+		}
+		return next
+	case "ip-hash":
+		h := fnv.New32a()
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			h.Write([]byte(host))
+		}
+		return available[h.Sum32()%uint32(len(available))]
+	default:
+		p.next++
+		return available[(p.next-1)%len(available)]
+	}
+}
+
+func (p *Proxy) pickWeighted(r *http.Request, available []*upstream) *upstream {
+	total := 0
+	for _, us := range available {
+		total += us.weight
+	}
+	if total == 0 {
+		return nil
+	} else if c, err := r.Cookie(p.split.Cookie); p.split.Cookie != "" && err == nil {
+		for _, us := range available {
+			if us.id == c.Value && us.weight != 0 {
+				return us
+			}
+		}
+	}
+	n := rand.Intn(total)
+	for _, us := range available {
+		if n -= us.weight; n < 0 {
+			return us
+		}
+	}
+	return nil
+}
+
+// mark marks an upstream as down after connection errors and backs off exponentially.
+// Canceled requests are the client's fault and don't count.
+func (p *Proxy) mark(us *upstream, err error) {
+	p.Lock()
+	defer p.Unlock()
+	if err == nil {
+		us.failures, us.downUntil = 0, time.Time{}
+		return
+	} else if errors.Is(err, context.Canceled) {
+		return
+	}
+	backoff := minBackoff << us.failures
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	} else {
+		us.failures++
+	}
+	us.downUntil = time.Now().Add(backoff)
+}
+
+// ActiveWeights returns the weights of the canary percentage in CanaryFile or the configured Weights.
+func (s Split) ActiveWeights() ([]int, error) {
+	if s.CanaryFile == "" {
+		return s.Weights, nil
+	}
+	bs, err := os.ReadFile(s.CanaryFile)
+	if os.IsNotExist(err) {
+		return s.Weights, nil
+	} else if err != nil {
+		return nil, err
+	}
+	percent, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("%s: percent must be between 0 and 100: %q", s.CanaryFile, bs)
+	} else if len(s.Weights) != 2 {
+		return nil, fmt.Errorf("%s: canary requires 2 weights got %d", s.CanaryFile, len(s.Weights))
+	}
+	return []int{100 - percent, percent}, nil
+}
+
+func (bg BlueGreen) Target() (string, error) {
+	color := "blue"
+	if bs, err := os.ReadFile(bg.ColorFile); err == nil {
+		color = strings.TrimSpace(string(bs))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if t, ok := bg.Targets[color]; ok {
+		return t, nil
+	}
+	return "", fmt.Errorf("no target for color %q", color)
+}
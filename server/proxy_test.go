@@ -0,0 +1,442 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler(t *testing.T) {
+	a, b := upstreamServer("a"), upstreamServer("b")
+	defer a.Close()
+	defer b.Close()
+	down := upstreamServer("down")
+	down.Close()
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "unix")
+	}))
+	unix.Listener = l
+	unix.Start()
+	defer unix.Close()
+
+	testProxy(t, "unix socket", []string{"unix:" + socket, a.URL}, "", "unix a unix a")
+	testProxy(t, "round-robin", []string{a.URL, b.URL}, "", "a b a b")
+	testProxy(t, "least-connections", []string{a.URL, b.URL}, "least-connections", "a a a a")
+	testProxy(t, "ip-hash", []string{a.URL, b.URL}, "ip-hash", "a a a a")
+	testProxy(t, "passive health check", []string{down.URL, a.URL}, "", "502 a a a")
+}
+
+func TestProxyHealthCheck(t *testing.T) {
+	healthy := upstreamServer("healthy")
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer unhealthy.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hc := HealthCheck{Path: "/health", Interval: Duration(10 * time.Millisecond)}
+
+	p, err := ProxyHandler([]string{unhealthy.URL, healthy.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HealthCheck(ctx, hc, nil)
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "healthy" {
+			t.Fatalf("expected healthy upstream got %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	p, err = ProxyHandler([]string{unhealthy.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HealthCheck(ctx, hc, nil)
+	time.Sleep(50 * time.Millisecond)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 got %d", w.Code)
+	}
+}
+
+func TestOnDemandHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	server, calls := (*httptest.Server)(nil), make(chan string, 10)
+	defer func(start, stop func(string) error) { startUnit, stopUnit = start, stop }(startUnit, stopUnit)
+	startUnit = func(unit string) error {
+		calls <- "start " + unit
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			l, _ := net.Listen("tcp", addr)
+			server = &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "app") })}}
+			server.Start()
+		}()
+		return nil
+	}
+	stopUnit = func(unit string) error {
+		calls <- "stop " + unit
+		server.Close()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := ProxyHandler([]string{"http://" + addr}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := OnDemandHandler(ctx, p, OnDemand{Unit: "app.target", IdleTimeout: Duration(100 * time.Millisecond)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "app" {
+			t.Fatalf("expected app to be started got %d %q", w.Code, w.Body.String())
+		}
+	}
+	for _, expected := range []string{"start app.target", "stop app.target"} {
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Fatalf("expected %q got %q", expected, call)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q", expected)
+		}
+	}
+}
+
+func TestOnDemandHandlerExternallyStopped(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	server, starts := (*httptest.Server)(nil), 0
+	defer func(start, stop func(string) error) { startUnit, stopUnit = start, stop }(startUnit, stopUnit)
+	startUnit = func(unit string) error {
+		starts++
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		server = &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "app") })}}
+		server.Start()
+		return nil
+	}
+	stopUnit = func(unit string) error { t.Fatalf("unexpected stop of %s", unit); return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := ProxyHandler([]string{"http://" + addr}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := OnDemandHandler(ctx, p, OnDemand{Unit: "crashing.target", IdleTimeout: Duration(time.Hour)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		onDemandUnits.Lock()
+		delete(onDemandUnits.m, "crashing.target")
+		onDemandUnits.Unlock()
+	}()
+	for i, expected := range []int{200, 502, 200} {
+		if i == 1 {
+			server.Close() // e.g. k stop or a crash
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != expected {
+			t.Fatalf("request %d: expected %d got %d", i, expected, w.Code)
+		}
+	}
+	server.Close()
+	if starts != 2 {
+		t.Fatalf("expected the stopped unit to be started again: %d starts", starts)
+	}
+}
+
+func TestOnDemandHandlerSharedUnit(t *testing.T) {
+	release := make(chan struct{})
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprint(w, "app")
+	}))
+	defer app.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+	stops := make(chan string, 10)
+	defer func(start, stop func(string) error) { startUnit, stopUnit = start, stop }(startUnit, stopUnit)
+	startUnit = func(string) error { return nil }
+	stopUnit = func(unit string) error { stops <- unit; return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hs := []http.Handler{}
+	for i := 0; i < 2; i++ {
+		p, err := ProxyHandler([]string{app.URL}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := OnDemandHandler(ctx, p, OnDemand{Unit: "shared.target", IdleTimeout: Duration(100 * time.Millisecond)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs = append(hs, h)
+	}
+	done := make(chan struct{})
+	go func() {
+		hs[0].ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	select {
+	case unit := <-stops:
+		t.Fatalf("expected %s to keep running while a route is busy", unit)
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	select {
+	case <-stops:
+	case <-time.After(time.Second):
+		t.Fatal("expected shared.target to be stopped once idle")
+	}
+}
+
+func TestBlueGreen(t *testing.T) {
+	blue, green := upstreamServer("blue"), upstreamServer("green")
+	defer blue.Close()
+	defer green.Close()
+	bg := BlueGreen{ColorFile: filepath.Join(t.TempDir(), "app.color"), Targets: map[string]string{"blue": blue.URL, "green": green.URL}}
+	r := &Route{BlueGreen: &bg, Patterns: []string{"/"}}
+	for _, color := range []string{"", "green\n", "blue", "red"} {
+		if color != "" {
+			if err := os.WriteFile(bg.ColorFile, []byte(color), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h, err := r.Handler(context.Background())
+		if color == "red" && err == nil {
+			t.Fatal("expected error for unknown color")
+		} else if color == "red" {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		w, expected := httptest.NewRecorder(), strings.TrimSpace(color)
+		if expected == "" {
+			expected = "blue"
+		}
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.String() != expected {
+			t.Fatalf("expected %q got %q", expected, w.Body.String())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := WaitHealthy(ctx, green.URL, HealthCheck{Interval: Duration(10 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	green.Close()
+	if err := WaitHealthy(ctx, green.URL, HealthCheck{Interval: Duration(10 * time.Millisecond)}); err == nil {
+		t.Fatal("expected closed upstream to be unhealthy")
+	}
+}
+
+func TestProxySplit(t *testing.T) {
+	stable, canary := upstreamServer("stable"), upstreamServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := ProxyHandler([]string{stable.URL, canary.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := p.Split(ctx, Split{Weights: []int{1}}, nil); err == nil {
+		t.Fatal("expected error for missing weight")
+	} else if err := p.Split(ctx, Split{Weights: []int{80, 20}, Cookie: "v"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	counts, cookies := map[string]int{}, map[string]string{}
+	for i := 0; i < 1000; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		counts[w.Body.String()]++
+		cookies[w.Body.String()] = w.Result().Cookies()[0].Value
+	}
+	if counts["stable"] < 700 || counts["canary"] < 100 {
+		t.Fatalf("unexpected split: %v", counts)
+	}
+	for version, cookie := range cookies {
+		for i := 0; i < 10; i++ {
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "v", Value: cookie})
+			if p.ServeHTTP(w, r); w.Body.String() != version || len(w.Result().Cookies()) != 0 {
+				t.Fatalf("expected sticky %s got %s %v", version, w.Body.String(), w.Result().Cookies())
+			}
+		}
+	}
+	if n := p.upstreams[1].statuses[200]; n < 100 {
+		t.Fatalf("expected status counts for canary got %v", p.upstreams[1].statuses)
+	}
+
+	s := Split{Weights: []int{100, 0}, CanaryFile: filepath.Join(t.TempDir(), "app.canary")}
+	for _, c := range []struct {
+		content  string
+		expected []int
+	}{{"", []int{100, 0}}, {"25\n", []int{75, 25}}, {"101", nil}} {
+		if c.content != "" {
+			if err := os.WriteFile(s.CanaryFile, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if weights, err := s.ActiveWeights(); !reflect.DeepEqual(weights, c.expected) || (err != nil) != (c.expected == nil) {
+			t.Fatalf("%q: expected weights %v got %v %v", c.content, c.expected, weights, err)
+		}
+	}
+	os.WriteFile(s.CanaryFile, []byte("25"), 0644)
+	if err := p.Split(ctx, s, nil); err != nil {
+		t.Fatal(err)
+	} else if p.upstreams[0].weight != 75 || p.upstreams[1].weight != 25 {
+		t.Fatalf("expected canary weights to be active: %d %d", p.upstreams[0].weight, p.upstreams[1].weight)
+	}
+}
+
+func TestMirrorHandler(t *testing.T) {
+	mirrored := make(chan string, 10)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		time.Sleep(100 * time.Millisecond)
+		mirrored <- fmt.Sprintf("%s %s %s", r.Method, r.URL, bs)
+	}))
+	defer mirror.Close()
+	h, err := MirrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		w.Write(bs)
+	}), Mirror{Target: mirror.URL, MaxBodySize: 8}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, expected := range map[string]string{"small": "POST /foo?x=1 small", "too large": ""} {
+		start, w := time.Now(), httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/foo?x=1", strings.NewReader(body)))
+		if d := time.Since(start); w.Body.String() != body || d > 50*time.Millisecond {
+			t.Fatalf("expected %q to be served immediately got %q after %s", body, w.Body.String(), d)
+		}
+		select {
+		case m := <-mirrored:
+			if m != expected {
+				t.Fatalf("expected mirror to receive %q got %q", expected, m)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if expected != "" {
+				t.Fatalf("expected mirror to receive %q", expected)
+			}
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s %s", r.Host, r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Request-Id"))
+	}))
+	defer upstream.Close()
+	trusted, _ := parseCIDRs([]string{"127.0.0.1"})
+	for _, c := range []struct {
+		name, remoteAddr string
+		rewriteHost      bool
+		headers          map[string]string
+		expected         string
+	}{
+		{"default", "8.8.8.8:1234", false, nil, "example.com example.com http %[2]s"},
+		{"rewrite host", "8.8.8.8:1234", true, nil, "%[1]s example.com http %[2]s"},
+		{"untrusted", "8.8.8.8:1234", false, map[string]string{"X-Forwarded-Host": "evil.com", "X-Forwarded-Proto": "https", "X-Request-Id": "abc"}, "example.com example.com http %[2]s"},
+		{"trusted", "127.0.0.1:1234", false, map[string]string{"X-Forwarded-Host": "other.com", "X-Forwarded-Proto": "https", "X-Request-Id": "abc"}, "example.com other.com https %[2]s"},
+		{"trusted invalid id", "127.0.0.1:1234", false, map[string]string{"X-Request-Id": "a b"}, "example.com example.com http %[2]s"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := ProxyHandler([]string{upstream.URL}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.rewriteHost = c.rewriteHost
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = c.remoteAddr
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+			forwardedHandler(p, trusted).ServeHTTP(w, r)
+			id := w.Header().Get("X-Request-Id")
+			if c.name == "trusted" && id != "abc" || c.name != "trusted" && len(id) != 32 {
+				t.Fatalf("unexpected request id %q", id)
+			}
+			expected := fmt.Sprintf(c.expected, strings.TrimPrefix(upstream.URL, "http://"), id)
+			if body := w.Body.String(); body != expected {
+				t.Fatalf("expected %q got %q", expected, body)
+			}
+		})
+	}
+}
+
+func testProxy(t *testing.T, name string, targets []string, strategy, expected string) {
+	t.Run(name, func(t *testing.T) {
+		h, err := ProxyHandler(targets, strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{}
+		for i := 0; i < len(strings.Fields(expected)); i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != http.StatusOK {
+				actual = append(actual, fmt.Sprint(w.Code))
+			} else {
+				bs, _ := io.ReadAll(w.Body)
+				actual = append(actual, string(bs))
+			}
+		}
+		if s := strings.Join(actual, " "); s != expected {
+			t.Fatalf("expected %q got %q", expected, s)
+		}
+	})
+}
+
+func upstreamServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted func() cidrs
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted cidrs
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var proxyProtocolTimeout = 10 * time.Second
+
+// newProxyProtocolListener expects a PROXY protocol (v1 or v2) header on connections from trusted
+// proxies - or from everyone if there are none - and uses the source address as RemoteAddr.
+// Connections from other peers are passed through as is. The header is read on first use of
+// the connection so a slow client does not block Accept.
+func newProxyProtocolListener(l net.Listener, trusted func() cidrs) net.Listener {
+	return &proxyProtocolListener{l, trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c), trusted: l.trusted()}, nil
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if len(c.trusted) != 0 && !c.trusted.contains(remoteIP(c.remote.String())) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		if remote, err := readProxyHeader(c.r); err != nil {
+			c.err = fmt.Errorf("proxy protocol %s: %w", c.remote, err)
+			c.Conn.Close()
+		} else if remote != nil {
+			c.remote = remote
+		}
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(bs []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(bs)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.init()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.init()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyHeader returns the source address from a v1 or v2 header. It returns nil
+// for headers without an address, e.g. health checks from the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	bs, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	} else if bytes.HasPrefix(bs, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	} else if bytes.Equal(bs, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == 107 {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fs := strings.Fields(string(line))
+	if len(fs) >= 2 && fs[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fs) != 6 || (fs[1] != "TCP4" && fs[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header: %q", line)
+	}
+	ip, port, err := net.ParseIP(fs[2]), 0, error(nil)
+	if ip == nil {
+		return nil, fmt.Errorf("bad v1 source address: %q", fs[2])
+	} else if port, err = strconv.Atoi(fs[4]); err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad v1 source port: %q", fs[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	} else if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("bad v2 version: %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	command, family := header[12]&0xf, header[13]>>4
+	if command == 0 {
+		return nil, nil
+	} else if command != 1 {
+		return nil, fmt.Errorf("bad v2 command: %d", command)
+	}
+	switch {
+	case family == 1 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case family == 2 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	address := serveProxyProtocol(t, "127.0.0.1")
+	v2 := append([]byte{}, proxyProtocolV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 127, 0, 0, 1)
+	v2 = appendUint16(appendUint16(v2, 4711), 443)
+	v2local := append(append([]byte{}, proxyProtocolV2Signature...), 0x20, 0, 0, 0)
+	for _, c := range []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{"v1", []byte("PROXY TCP4 192.0.2.1 127.0.0.1 4711 443\r\n"), "192.0.2.1:4711"},
+		{"v1 ipv6", []byte("PROXY TCP6 2001:db8::1 ::1 4711 443\r\n"), "[2001:db8::1]:4711"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1:"},
+		{"v2", v2, "192.0.2.1:4711"},
+		{"v2 local", v2local, "127.0.0.1:"},
+		{"missing", nil, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			actual := proxyProtocolRequest(t, address, c.header)
+			if !strings.HasPrefix(actual, c.expected) || (c.expected == "") != (actual == "") {
+				t.Fatalf("expected %q got %q", c.expected, actual)
+			}
+		})
+	}
+
+	if actual := proxyProtocolRequest(t, serveProxyProtocol(t, "10.0.0.1"), nil); !strings.HasPrefix(actual, "127.0.0.1:") {
+		t.Fatalf("expected untrusted connection without header to be served: %q", actual)
+	}
+}
+
+func serveProxyProtocol(t *testing.T, trustedProxy string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := parseCIDRs([]string{trustedProxy})
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go s.Serve(newProxyProtocolListener(l, func() cidrs { return trusted }))
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func proxyProtocolRequest(t *testing.T, address string, header []byte) string {
+	c, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(append(header, "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"...))
+	bs, _ := io.ReadAll(c)
+	if i := bytes.Index(bs, []byte("\r\n\r\n")); i != -1 {
+		return string(bs[i+4:])
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	RPS    float64
+	Burst  int
+	Conns  int
+	FullIP bool
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	RateLimit
+	clients map[string]*client
+	swept   time.Time
+}
+
+type client struct {
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+var rateLimitSweepInterval = time.Minute
+
+// RateLimitHandler limits requests per second (token bucket with burst) and concurrent requests
+// per client IP. Clients are keyed by the masked IP (see maskIP) unless FullIP is set.
+func RateLimitHandler(next http.Handler, rl RateLimit) (http.Handler, error) {
+	if rl.RPS < 0 || rl.Burst < 0 || rl.Conns < 0 {
+		return nil, fmt.Errorf("rate limit must not be negative: %v", rl)
+	} else if rl.RPS > 0 && rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.RPS))
+	}
+	l := &rateLimiter{RateLimit: rl, clients: map[string]*client{}, swept: time.Now()}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := maskIP(r.RemoteAddr)
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && l.FullIP {
+			key = host
+		}
+		if wait, ok := l.acquire(key); !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(key)
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+func (l *rateLimiter) acquire(key string) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	c := l.clients[key]
+	if c == nil {
+		c = &client{tokens: float64(l.Burst), last: now}
+		l.clients[key] = c
+	}
+	if l.Conns > 0 && c.conns >= l.Conns {
+		return time.Second, false
+	}
+	if l.RPS > 0 {
+		c.tokens = math.Min(float64(l.Burst), c.tokens+now.Sub(c.last).Seconds()*l.RPS)
+		c.last = now
+		if c.tokens < 1 {
+			return time.Duration((1 - c.tokens) / l.RPS * float64(time.Second)), false
+		}
+		c.tokens--
+	}
+	c.conns++
+	return 0, true
+}
+
+func (l *rateLimiter) release(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if c := l.clients[key]; c != nil {
+		c.conns--
+	}
+}
+
+// sweep drops idle clients with a full bucket - they are indistinguishable from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for key, c := range l.clients {
+		if c.conns == 0 && (l.RPS == 0 || c.tokens+now.Sub(c.last).Seconds()*l.RPS >= float64(l.Burst)) {
+			delete(l.clients, key)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RFC2136 publishes dns-01 records via dynamic updates (over TCP) to Server (host:port)
+// for Zone. Updates are signed with TSIG if TSIGKeyName is set; TSIGSecret is base64
+// encoded and TSIGAlgorithm defaults to hmac-sha256.
+type RFC2136 struct {
+	Server        string
+	Zone          string
+	TTL           int
+	TSIGKeyName   string
+	TSIGSecret    string
+	TSIGAlgorithm string
+}
+
+const (
+	dnsOpCodeUpdate = 5
+	dnsClassNone    = dnsmessage.Class(254)
+	dnsClassAny     = dnsmessage.Class(255)
+	dnsTypeTSIG     = dnsmessage.Type(250)
+	tsigFudge       = 300
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+func (r *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, value, false)
+}
+
+func (r *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, value, true)
+}
+
+// update adds or deletes the TXT record fqdn with value. Deletion only removes the
+// record with the given value so concurrent challenges for the same name do not interfere.
+func (r *RFC2136) update(ctx context.Context, fqdn, value string, remove bool) error {
+	zone, err := dnsmessage.NewName(canonicalName(r.Zone))
+	if err != nil {
+		return err
+	}
+	name, err := dnsmessage.NewName(canonicalName(fqdn))
+	if err != nil {
+		return err
+	}
+	bs := make([]byte, 2)
+	if _, err := rand.Read(bs); err != nil {
+		return err
+	}
+	id, ttl, class := binary.BigEndian.Uint16(bs), uint32(r.TTL), dnsmessage.ClassINET
+	if ttl == 0 {
+		ttl = 60
+	}
+	if remove {
+		ttl, class = 0, dnsClassNone
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: dnsOpCodeUpdate})
+	if err := b.StartQuestions(); err != nil {
+		return err
+	} else if err := b.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return err
+	} else if err := b.StartAuthorities(); err != nil {
+		return err
+	}
+	h := dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	if err := b.TXTResource(h, dnsmessage.TXTResource{TXT: []string{value}}); err != nil {
+		return err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	if r.TSIGKeyName != "" {
+		if msg, err = r.sign(msg, time.Now()); err != nil {
+			return err
+		}
+	}
+	res, err := r.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	p := dnsmessage.Parser{}
+	if rh, err := p.Start(res); err != nil {
+		return err
+	} else if rh.ID != id {
+		return fmt.Errorf("rfc2136: response id mismatch")
+	} else if rh.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rfc2136: update %s: %s", fqdn, rh.RCode)
+	}
+	return nil
+}
+
+func (r *RFC2136) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, "tcp", r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	c.SetDeadline(deadline)
+	if _, err := c.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	bs := make([]byte, 2)
+	if _, err := io.ReadFull(c, bs); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(bs))
+	_, err = io.ReadFull(c, res)
+	return res, err
+}
+
+// sign appends a TSIG record (RFC 8945) to msg.
+func (r *RFC2136) sign(msg []byte, t time.Time) ([]byte, error) {
+	algorithm := canonicalName(r.TSIGAlgorithm)
+	if r.TSIGAlgorithm == "" {
+		algorithm = "hmac-sha256."
+	}
+	newHash, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("rfc2136: unsupported TSIG algorithm %q", r.TSIGAlgorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(r.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("rfc2136: invalid TSIGSecret: %w", err)
+	}
+	keyName, err := wireName(canonicalName(r.TSIGKeyName))
+	if err != nil {
+		return nil, err
+	}
+	algorithmName, _ := wireName(algorithm)
+	timeSigned := make([]byte, 6)
+	binary.BigEndian.PutUint16(timeSigned, uint16(t.Unix()>>32))
+	binary.BigEndian.PutUint32(timeSigned[2:], uint32(t.Unix()))
+
+	mac := hmac.New(newHash, secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{byte(dnsClassAny >> 8), byte(dnsClassAny), 0, 0, 0, 0})
+	mac.Write(algorithmName)
+	mac.Write(timeSigned)
+	mac.Write([]byte{tsigFudge >> 8, tsigFudge & 0xff, 0, 0, 0, 0})
+	sum := mac.Sum(nil)
+
+	rdata := append(append([]byte{}, algorithmName...), timeSigned...)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0], msg[1], 0, 0, 0, 0)
+
+	out := append(append([]byte{}, msg...), keyName...)
+	out = appendUint16(out, uint16(dnsTypeTSIG))
+	out = appendUint16(out, uint16(dnsClassAny))
+	out = appendUint16(append(out, 0, 0, 0, 0), uint16(len(rdata)))
+	out = append(out, rdata...)
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, nil
+}
+
+func appendUint16(bs []byte, v uint16) []byte {
+	return append(bs, byte(v>>8), byte(v))
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// wireName encodes name uncompressed as required for TSIG.
+func wireName(name string) ([]byte, error) {
+	bs := []byte{}
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		bs = append(append(bs, byte(len(l))), l...)
+	}
+	return append(bs, 0), nil
+}
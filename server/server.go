@@ -1,115 +1,306 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/niklasfasching/k/util"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/errgroup"
 )
 
 type Config struct {
-	HTTP, HTTPS          int
-	LetsEncryptEmail     string
-	LetsEncryptCachePath string
-	Routes               []*Route
+	HTTP, HTTPS           int
+	LetsEncryptEmail      string
+	LetsEncryptCachePath  string
+	ACMEDirectoryURL      string
+	EAB                   *EAB
+	DNS01                 []*DNS01
+	CertExpiryWarningDays int
+	Certificates          []Certificate
+	LocalCA               *LocalCA
+	Routes                []*Route
+	Passthrough           []*Passthrough
+	TrustedProxies        []string
+	ProxyProtocol         []string
+	MetricsAddress        string
+
+	path  string
+	state atomic.Value
+}
+
+type state struct {
+	http.Handler
+	hostPolicy   autocert.HostPolicy
+	passthroughs passthroughs
+	certificates certificates
+	localCA      *localCA
+	trusted      cidrs
+	cancel       context.CancelFunc
 }
 
 type Route struct {
-	Patterns  []string
-	Target    string
-	BasicAuth BasicAuth
-	LogFormat string
-	Headers   map[string]string
-	LogFields map[string]string
-	ErrPaths  map[int]string
+	Patterns       []string
+	Target         string
+	Targets        []string
+	Balance        string
+	RewriteHost    bool
+	RedirectStatus int
+	Rewrite        []Rewrite
+	PreservePrefix bool
+	StaticOptions
+	BasicAuth     BasicAuth
+	LogFormat     string
+	LogStructured bool
+	Headers       map[string]string
+	LogFields     map[string]string
+	ErrPaths      map[int]string
+	HealthCheck   *HealthCheck
+	Split         *Split
+	Mirror        *Mirror
+	OnDemand      *OnDemand
+	BlueGreen     *BlueGreen
+	RateLimit     *RateLimit
+	Compress      *Compress
+	AllowHTTP     bool
+	HSTS          *HSTS
+	OIDC          *OIDC
+	Allow, Deny   []string
+}
+
+type Rewrite struct {
+	Pattern, Replacement string
 }
 
+type Duration time.Duration
+
+var errRestartRequired = errors.New("SIGHUP: server config changed - restart required")
+
+// journalLog is replaceable for tests.
+var journalLog = util.JournalLog
+
 func Start(configPath string) error {
-	c, err := readConfig(configPath)
+	c, err := ReadConfig(configPath)
 	if err != nil {
 		return err
 	}
+	c.path = configPath
 	return c.Start()
 }
 
 func (c *Config) Start() error {
-	handler, hostnames, err := c.getHandlerAndHostnames()
-	if err != nil {
+	for _, name := range c.ProxyProtocol {
+		if name != "http" && name != "https" {
+			return fmt.Errorf("ProxyProtocol: unknown listener %q", name)
+		}
+	}
+	if err := c.reload(c); err != nil {
 		return err
 	}
-	if isHTTPS := c.LetsEncryptEmail != ""; !isHTTPS {
-		log.Println("LetsEncryptEmail not set - only listening for http")
+	go func() { log.Fatal(c.watch()) }()
+	g := errgroup.Group{}
+	if c.MetricsAddress != "" {
+		g.Go(func() error {
+			log.Printf("Serving metrics on %s", c.MetricsAddress)
+			return http.ListenAndServe(c.MetricsAddress, defaultMetrics)
+		})
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.state.Load().(*state).ServeHTTP(w, r)
+	})
+	if !c.listensHTTPS() {
+		log.Println("LetsEncryptEmail, Certificates, LocalCA, DNS01 and Passthrough not set - only listening for http")
 		log.Printf("Listening on :%d", c.HTTP)
-		return c.serve(&http.Server{Handler: handler})
+		g.Go(func() error { return c.serve(&http.Server{Handler: handler}) })
+		return g.Wait()
+	}
+	eab, err := c.EAB.binding()
+	if err != nil {
+		return err
+	}
+	cache := autocert.DirCache(c.LetsEncryptCachePath)
+	rs, dns01 := loadRenewals(context.Background(), cache), (*dns01Manager)(nil)
+	if len(c.DNS01) != 0 {
+		if dns01, err = newDNS01Manager(c, eab, rs); err != nil {
+			return err
+		}
+		g.Go(func() error { return dns01.run(context.Background()) })
 	}
-	g := errgroup.Group{}
 	m := autocert.Manager{
-		Prompt:     func(string) bool { return c.LetsEncryptEmail != "" },
-		Email:      c.LetsEncryptEmail,
-		Cache:      autocert.DirCache(c.LetsEncryptCachePath),
-		HostPolicy: autocert.HostWhitelist(hostnames...),
+		Prompt:                 func(string) bool { return c.LetsEncryptEmail != "" },
+		Email:                  c.LetsEncryptEmail,
+		Cache:                  recordingCache{cache, rs},
+		Client:                 &acme.Client{DirectoryURL: c.ACMEDirectoryURL},
+		ExternalAccountBinding: eab,
+		HostPolicy: func(ctx context.Context, host string) error {
+			return c.state.Load().(*state).hostPolicy(ctx, host)
+		},
 	}
 	g.Go(func() error {
-		autocertHandler := m.HTTPHandler(nil)
-		return c.serve(&http.Server{
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") {
-					handler.ServeHTTP(w, r)
-					return
-				}
-				autocertHandler.ServeHTTP(w, r)
-			}),
-		})
+		return c.serve(&http.Server{Handler: m.HTTPHandler(handler)})
 	})
+	tlsConfig := m.TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s := c.state.Load().(*state)
+		if cert := s.certificates.match(hello.ServerName); cert != nil {
+			return cert, nil
+		} else if s.localCA != nil && s.localCA.matches(hello.ServerName) {
+			if err := s.hostPolicy(hello.Context(), hello.ServerName); err != nil {
+				return nil, err
+			}
+			return s.localCA.certificate(hello.ServerName)
+		} else if dns01 != nil {
+			if cert := dns01.match(hello.ServerName); cert != nil {
+				return cert, nil
+			}
+		}
+		if c.LetsEncryptEmail == "" {
+			return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+		}
+		cert, err := m.GetCertificate(hello)
+		if err != nil && s.hostPolicy(hello.Context(), hello.ServerName) == nil {
+			rs.record(hello.ServerName, err)
+		}
+		return cert, err
+	}
+	go c.monitorCertificates(context.Background())
 	g.Go(func() error {
-		return c.serve(&http.Server{Handler: handler, TLSConfig: m.TLSConfig()})
+		return c.serve(&http.Server{Handler: handler, TLSConfig: tlsConfig})
 	})
 	log.Printf("Listening on :%d and :%d", c.HTTP, c.HTTPS)
 	return g.Wait()
 }
 
+// watch reloads the routes on SIGHUP. Listeners stay open and in-flight requests
+// are finished by the previous handler. Changes to anything but the routes
+// require a restart - watch returns errRestartRequired and we leave that to systemd.
+func (c *Config) watch() error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for range ch {
+		if err := c.reloadFromPath(); errors.Is(err, errRestartRequired) {
+			return err
+		} else if err != nil {
+			log.Printf("SIGHUP: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) reloadFromPath() error {
+	if c.path == "" {
+		return fmt.Errorf("no config path to reload from")
+	}
+	c2, err := ReadConfig(c.path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if c.HTTP != c2.HTTP || c.HTTPS != c2.HTTPS || c.listensHTTPS() != c2.listensHTTPS() ||
+		c.LetsEncryptEmail != c2.LetsEncryptEmail || c.LetsEncryptCachePath != c2.LetsEncryptCachePath ||
+		c.ACMEDirectoryURL != c2.ACMEDirectoryURL || !reflect.DeepEqual(c.EAB, c2.EAB) ||
+		!reflect.DeepEqual(c.DNS01, c2.DNS01) || c.MetricsAddress != c2.MetricsAddress ||
+		c.CertExpiryWarningDays != c2.CertExpiryWarningDays || !reflect.DeepEqual(c.ProxyProtocol, c2.ProxyProtocol) {
+		return errRestartRequired
+	} else if err := c.reload(c2); err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+	log.Printf("SIGHUP: reloaded %d routes from %s", len(c2.Routes), c.path)
+	return nil
+}
+
+func (c *Config) reload(c2 *Config) error {
+	ps, err := newPassthroughs(c2.Passthrough)
+	if err != nil {
+		return err
+	}
+	certs, err := loadCertificates(c2.Certificates)
+	if err != nil {
+		return err
+	}
+	ca := (*localCA)(nil)
+	if c2.LocalCA != nil {
+		if ca, err = newLocalCA(*c2.LocalCA); err != nil {
+			return fmt.Errorf("LocalCA: %w", err)
+		}
+	}
+	trusted, err := parseCIDRs(c2.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("TrustedProxies: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	handler, hostnames, err := c2.getHandlerAndHostnames(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if s, ok := c.state.Load().(*state); ok {
+		defer s.cancel()
+	}
+	c.state.Store(&state{handler, autocert.HostWhitelist(hostnames...), ps, certs, ca, trusted, cancel})
+	c.Routes, c.Passthrough, c.Certificates, c.LocalCA = c2.Routes, c2.Passthrough, c2.Certificates, c2.LocalCA
+	return nil
+}
+
 func (c *Config) serve(s *http.Server) error {
 	ls, err := listenFDs()
 	if err != nil {
 		return err
 	}
+	name, port := "http", c.HTTP
 	if s.TLSConfig != nil {
-		l := ls["https"]
-		if l == nil {
-			l, err = net.Listen("tcp", fmt.Sprintf(":%d", c.HTTPS))
-			if err != nil {
-				return err
-			}
-		}
-		return s.ServeTLS(l, "", "")
+		name, port = "https", c.HTTPS
 	}
-	l := ls["http"]
+	l := ls[name]
 	if l == nil {
-		l, err = net.Listen("tcp", fmt.Sprintf(":%d", c.HTTP))
+		l, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
 		if err != nil {
 			return err
 		}
 	}
+	for _, n := range c.ProxyProtocol {
+		if n == name {
+			l = newProxyProtocolListener(l, func() cidrs { return c.state.Load().(*state).trusted })
+		}
+	}
+	if s.TLSConfig != nil {
+		return s.ServeTLS(newSNIListener(l, func(serverName string) *Passthrough {
+			return c.state.Load().(*state).passthroughs.match(serverName)
+		}), "", "")
+	}
 	return s.Serve(l)
 }
 
-func (c *Config) getHandlerAndHostnames() (http.Handler, []string, error) {
+func (c *Config) getHandlerAndHostnames(ctx context.Context) (http.Handler, []string, error) {
+	trusted, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return nil, nil, fmt.Errorf("TrustedProxies: %w", err)
+	}
 	mux, hostnames := http.NewServeMux(), []string{}
 	for _, r := range c.Routes {
-		h, err := r.Handler()
+		h, err := r.Handler(ctx)
 		if err != nil {
-			util.JournalLog(fmt.Sprintf("bad route [%v]: %s", r.Patterns, err), "1", r.LogFields)
+			journalLog(fmt.Sprintf("bad route [%v]: %s", r.Patterns, err), "1", r.LogFields)
 			continue
 		}
+		if c.isHTTPS() {
+			h = HTTPSHandler(h, c.HTTPS, r.AllowHTTP, r.HSTS)
+		}
 		for _, pattern := range r.Patterns {
 			parts := strings.SplitN(pattern, "/", 2)
 			if len(parts) < 2 {
@@ -118,36 +309,129 @@ func (c *Config) getHandlerAndHostnames() (http.Handler, []string, error) {
 			if hostname := parts[0]; hostname != "" {
 				hostnames = append(hostnames, hostname)
 			}
-			mux.Handle(pattern, http.StripPrefix("/"+parts[1], h))
+			if r.PreservePrefix {
+				mux.Handle(pattern, h)
+			} else {
+				mux.Handle(pattern, http.StripPrefix("/"+parts[1], h))
+			}
 		}
 	}
-	return mux, hostnames, nil
+	return forwardedHandler(realIPHandler(mux, trusted), trusted), hostnames, nil
 }
 
-func (r *Route) Handler() (http.Handler, error) {
+func (r *Route) Handler(ctx context.Context) (http.Handler, error) {
 	h, err := http.Handler(nil), error(nil)
 	if strings.HasPrefix(r.Target, "/") {
-		h, err = StaticHandler(r.Target)
+		h, err = StaticHandler(r.Target, r.StaticOptions)
+	} else if strings.HasPrefix(r.Target, "redirect:") {
+		h, err = RedirectHandler(strings.TrimPrefix(r.Target, "redirect:"), r.RedirectStatus)
 	} else {
-		h, err = ProxyHandler(r.Target)
+		targets := r.Targets
+		if r.Target != "" {
+			targets = append([]string{r.Target}, targets...)
+		} else if r.BlueGreen != nil {
+			target, err := r.BlueGreen.Target()
+			if err != nil {
+				return nil, err
+			}
+			targets = append([]string{target}, targets...)
+		}
+		p, err := ProxyHandler(targets, r.Balance)
+		if err != nil {
+			return nil, err
+		}
+		p.rewriteHost = r.RewriteHost
+		if r.Split != nil {
+			if err := p.Split(ctx, *r.Split, r.LogFields); err != nil {
+				return nil, err
+			}
+		}
+		if r.HealthCheck != nil {
+			p.HealthCheck(ctx, *r.HealthCheck, r.LogFields)
+		}
+		h = p
+		if r.OnDemand != nil {
+			if h, err = OnDemandHandler(ctx, p, *r.OnDemand, r.LogFields); err != nil {
+				return nil, err
+			}
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
-	if r.Headers != nil {
-		h = HeaderHandler(h, r.Headers)
+	if r.Mirror != nil {
+		if h, err = MirrorHandler(h, *r.Mirror, r.LogFields); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.Rewrite) != 0 {
+		h, err = RewriteHandler(h, r.Rewrite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Compress != nil {
+		if strings.HasPrefix(r.Target, "/") {
+			h = PrecompressedHandler(h, r.Target)
+		}
+		h = CompressHandler(h, *r.Compress)
+	}
+	defaults := map[string]string{}
+	for k, v := range defaultHeaders {
+		defaults[k] = v
 	}
-	h, err = LogHandler(h, r.LogFormat, r.LogFields, r.ErrPaths)
+	for k := range r.Headers {
+		delete(defaults, http.CanonicalHeaderKey(k))
+	}
+	h = HeaderHandler(DefaultHeaderHandler(h, defaults), r.Headers)
+	if len(r.ErrPaths) != 0 {
+		root := ""
+		if strings.HasPrefix(r.Target, "/") {
+			root = r.Target
+		}
+		h = ErrPageHandler(h, r.ErrPaths, root)
+	}
+	h, err = LogHandler(h, r.LogFormat, r.LogFields, r.LogStructured,
+		defaultMetrics.observer(r.LogFields["K"], strings.Join(r.Patterns, " ")))
 	if err != nil {
 		return nil, err
 	}
-	if r.BasicAuth != (BasicAuth{}) {
-		h = r.BasicAuth.Handler(h)
+	if r.BasicAuth.IsSet() {
+		h, err = r.BasicAuth.Handler(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.OIDC != nil {
+		h, err = OIDCHandler(h, *r.OIDC)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// rate limits apply before authentication - password hashes are expensive to verify
+	if r.RateLimit != nil {
+		h, err = RateLimitHandler(h, *r.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(r.Allow) != 0 || len(r.Deny) != 0 {
+		h, err = IPFilterHandler(h, r.Allow, r.Deny, r.LogFields)
 	}
 	return h, err
 }
 
-func readConfig(path string) (*Config, error) {
+func (c *Config) isHTTPS() bool {
+	return c.LetsEncryptEmail != "" || len(c.Certificates) != 0 || c.LocalCA != nil || len(c.DNS01) != 0
+}
+
+// listensHTTPS reports whether the https listener is needed - passthroughs don't need certificates
+// of our own, but without any routes aren't redirected to https (see isHTTPS).
+func (c *Config) listensHTTPS() bool {
+	return c.isHTTPS() || len(c.Passthrough) != 0
+}
+
+func ReadConfig(path string) (*Config, error) {
 	bs, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -156,6 +440,26 @@ func readConfig(path string) (*Config, error) {
 	return c, json.Unmarshal(bs, c)
 }
 
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	s := ""
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func logJournal(msg, priority string, fields map[string]string) {
+	if err := journalLog(msg, priority, fields); err != nil {
+		log.Printf("%s (journal log failed: %s)", msg, err)
+	}
+}
+
 // https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
 func listenFDs() (map[string]net.Listener, error) {
 	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "k-http.json")
+	writeConfig := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"HTTP": 8080, "Routes": [{"Patterns": ["/"], "Target": "redirect:https://a.example.com"}]}`)
+	c, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.path = path
+	if err := c.reload(c); err != nil {
+		t.Fatal(err)
+	}
+	location := func() string {
+		w := httptest.NewRecorder()
+		c.state.Load().(*state).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Header().Get("Location")
+	}
+	if l := location(); l != "https://a.example.com" {
+		t.Fatalf("unexpected location: %q", l)
+	}
+
+	writeConfig(`{"HTTP": 8080, "Routes": [{"Patterns": ["/"], "Target": "redirect:https://b.example.com"}]}`)
+	if err := c.reloadFromPath(); err != nil {
+		t.Fatal(err)
+	} else if l := location(); l != "https://b.example.com" {
+		t.Fatalf("expected reloaded route: %q", l)
+	}
+
+	writeConfig(`{"HTTP": 8080, "Routes": [{"Patterns": ["bad"], "Target": "redirect:https://c.example.com"}]}`)
+	if err := c.reloadFromPath(); err == nil || errors.Is(err, errRestartRequired) {
+		t.Fatalf("expected reload error: %v", err)
+	} else if l := location(); l != "https://b.example.com" {
+		t.Fatalf("expected previous routes to be kept: %q", l)
+	}
+
+	writeConfig(`{"HTTP": 8081, "Routes": []}`)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP) // keep the default SIGHUP handler from killing the test
+	defer signal.Stop(ch)
+	errs := make(chan error, 1)
+	go func() { errs <- c.watch() }()
+	for i := 0; ; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		select {
+		case err := <-errs:
+			if !errors.Is(err, errRestartRequired) {
+				t.Fatalf("expected watch to return errRestartRequired: %v", err)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+			if i == 100 {
+				t.Fatal("watch did not return")
+			}
+		}
+	}
+}
@@ -107,28 +107,29 @@ func (p *Pipe) Receive() error {
 	return p.Encode(n)
 }
 
-func (p *Pipe) Send(localDir, remoteDir string) (int, error) {
+// Send returns the number of changed paths and the subset of those with changed content.
+func (p *Pipe) Send(localDir, remoteDir string) (int, []string, error) {
 	if err := p.Encode(remoteDir); err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	m, err := p.Walk(localDir)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	} else if err := p.Encode(m); err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	missing, n := []string{}, 0
 	if err := p.Decode(&missing); err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	for _, path := range missing {
 		start := time.Now()
 		if err := p.sendFile(filepath.Join(localDir, path), m[path].Size); err != nil {
-			return 0, err
+			return 0, nil, err
 		}
 		log.Println("SendFile", filepath.Join(localDir, path), remoteDir, time.Now().Sub(start))
 	}
-	return n, p.Decode(&n)
+	return n, missing, p.Decode(&n)
 }
 
 // TODO: could use modtime rather than sha for comparison
@@ -147,7 +147,7 @@ func sync(t *testing.T, name string, srcFs, dstFs []file, ignored map[string]boo
 		}
 		g.Go(func() error {
 			defer cancel()
-			if _, err := s.Send(srcDir, dstDir); err != nil {
+			if _, _, err := s.Send(srcDir, dstDir); err != nil {
 				return fmt.Errorf("send: %w", err)
 			}
 			return nil
@@ -0,0 +1,294 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dbusMessage struct {
+	kind        byte
+	serial      uint32
+	replySerial uint32
+	path        string
+	iface       string
+	member      string
+	destination string
+	errorName   string
+	signature   string
+	order       binary.ByteOrder
+	body        []byte
+}
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+)
+
+var systemBusSocket = "/run/dbus/system_bus_socket"
+
+// StartUnit starts a systemd unit via the D-Bus API. It returns once the job is queued.
+func StartUnit(name string) error { return systemdManagerCall("StartUnit", name) }
+
+// StopUnit stops a systemd unit via the D-Bus API. It returns once the job is queued.
+func StopUnit(name string) error { return systemdManagerCall("StopUnit", name) }
+
+// https://www.freedesktop.org/wiki/Software/systemd/dbus/
+func systemdManagerCall(method, unit string) error {
+	c, err := dbusConnect(systemBusSocket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	body := &bytes.Buffer{}
+	writeDBusString(body, unit)
+	writeDBusString(body, "replace")
+	_, err = dbusCall(c, 2, &dbusMessage{
+		path:        "/org/freedesktop/systemd1",
+		iface:       "org.freedesktop.systemd1.Manager",
+		member:      method,
+		destination: "org.freedesktop.systemd1",
+		signature:   "ss",
+		body:        body.Bytes(),
+	})
+	return err
+}
+
+// https://dbus.freedesktop.org/doc/dbus-specification.html#auth-protocol
+func dbusConnect(socket string) (net.Conn, error) {
+	c, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// the server only talks after we do - reading byte by byte keeps the buffer empty for BEGIN
+	line := []byte{}
+	for b := make([]byte, 1); !bytes.HasSuffix(line, []byte("\r\n")); line = append(line, b[0]) {
+		if _, err := c.Read(b); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(string(line), "OK ") {
+		c.Close()
+		return nil, fmt.Errorf("dbus auth failed: %q", strings.TrimSpace(string(line)))
+	} else if _, err := io.WriteString(c, "BEGIN\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	_, err = dbusCall(c, 1, &dbusMessage{
+		path:        "/org/freedesktop/DBus",
+		iface:       "org.freedesktop.DBus",
+		member:      "Hello",
+		destination: "org.freedesktop.DBus",
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func dbusCall(c net.Conn, serial uint32, m *dbusMessage) (*dbusMessage, error) {
+	m.kind, m.serial = dbusMethodCall, serial
+	if _, err := c.Write(m.marshal()); err != nil {
+		return nil, err
+	}
+	for {
+		m2, err := readDBusMessage(c)
+		if err != nil {
+			return nil, err
+		} else if m2.replySerial != serial {
+			continue
+		} else if m2.kind == dbusError {
+			msg := ""
+			if strings.HasPrefix(m2.signature, "s") {
+				msg, _ = readDBusString(&dbusReader{m2.order, m2.body, 0})
+			}
+			return nil, fmt.Errorf("%s %s: %s: %s", m.member, m.path, m2.errorName, msg)
+		}
+		return m2, nil
+	}
+}
+
+// https://dbus.freedesktop.org/doc/dbus-specification.html#message-protocol-messages
+func (m *dbusMessage) marshal() []byte {
+	fields := &bytes.Buffer{}
+	field := func(code byte, signature, v string) {
+		pad(fields, 8)
+		fields.Write([]byte{code, 1, signature[0], 0})
+		if signature == "g" {
+			fields.WriteByte(byte(len(v)))
+			fields.WriteString(v + "\x00")
+		} else if signature == "u" {
+			n, _ := strconv.ParseUint(v, 10, 32)
+			binary.Write(fields, binary.LittleEndian, uint32(n))
+		} else {
+			writeDBusString(fields, v)
+		}
+	}
+	if m.path != "" {
+		field(1, "o", m.path)
+	}
+	for _, f := range []struct {
+		code byte
+		v    string
+	}{{2, m.iface}, {3, m.member}, {4, m.errorName}, {6, m.destination}} {
+		if f.v != "" {
+			field(f.code, "s", f.v)
+		}
+	}
+	if m.replySerial != 0 {
+		field(5, "u", strconv.FormatUint(uint64(m.replySerial), 10))
+	}
+	if m.signature != "" {
+		field(8, "g", m.signature)
+	}
+	b := &bytes.Buffer{}
+	b.Write([]byte{'l', m.kind, 0, 1})
+	binary.Write(b, binary.LittleEndian, uint32(len(m.body)))
+	binary.Write(b, binary.LittleEndian, m.serial)
+	binary.Write(b, binary.LittleEndian, uint32(fields.Len()))
+	// fields were aligned relative to their own start which is 16 - i.e. 8 byte aligned
+	b.Write(fields.Bytes())
+	pad(b, 8)
+	b.Write(m.body)
+	return b.Bytes()
+}
+
+func readDBusMessage(r io.Reader) (*dbusMessage, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if h[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen, fieldsLen := order.Uint32(h[4:]), order.Uint32(h[12:])
+	if bodyLen > 1<<26 || fieldsLen > 1<<26 {
+		return nil, fmt.Errorf("dbus message too large")
+	}
+	n := 16 + int(fieldsLen)
+	n += (8 - n%8) % 8
+	bs := make([]byte, n+int(bodyLen))
+	copy(bs, h)
+	if _, err := io.ReadFull(r, bs[16:]); err != nil {
+		return nil, err
+	}
+	m := &dbusMessage{kind: h[1], serial: order.Uint32(h[8:]), order: order, body: bs[n:]}
+	dr := &dbusReader{order, bs[:16+fieldsLen], 16}
+	for dr.offset < len(dr.bs) {
+		dr.align(8)
+		code, err := dr.next(1)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := readDBusSignature(dr)
+		if err != nil {
+			return nil, err
+		}
+		v := ""
+		switch signature {
+		case "s", "o":
+			v, err = readDBusString(dr)
+		case "g":
+			v, err = readDBusSignature(dr)
+		case "u":
+			dr.align(4)
+			bs, rerr := dr.next(4)
+			if err = rerr; err == nil {
+				v = strconv.FormatUint(uint64(order.Uint32(bs)), 10)
+			}
+		default:
+			err = fmt.Errorf("unexpected dbus header field signature %q", signature)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch code[0] {
+		case 1:
+			m.path = v
+		case 2:
+			m.iface = v
+		case 3:
+			m.member = v
+		case 4:
+			m.errorName = v
+		case 5:
+			serial, _ := strconv.ParseUint(v, 10, 32)
+			m.replySerial = uint32(serial)
+		case 6:
+			m.destination = v
+		case 8:
+			m.signature = v
+		}
+	}
+	return m, nil
+}
+
+type dbusReader struct {
+	order  binary.ByteOrder
+	bs     []byte
+	offset int
+}
+
+func (r *dbusReader) align(n int) { r.offset += (n - r.offset%n) % n }
+
+func (r *dbusReader) next(n int) ([]byte, error) {
+	if r.offset+n > len(r.bs) {
+		return nil, fmt.Errorf("unexpected end of dbus message")
+	}
+	r.offset += n
+	return r.bs[r.offset-n : r.offset], nil
+}
+
+func readDBusString(r *dbusReader) (string, error) {
+	r.align(4)
+	bs, err := r.next(4)
+	if err != nil {
+		return "", err
+	}
+	s, err := r.next(int(r.order.Uint32(bs)) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(s[:len(s)-1]), nil
+}
+
+func readDBusSignature(r *dbusReader) (string, error) {
+	bs, err := r.next(1)
+	if err != nil {
+		return "", err
+	}
+	s, err := r.next(int(bs[0]) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(s[:len(s)-1]), nil
+}
+
+func writeDBusString(b *bytes.Buffer, s string) {
+	pad(b, 4)
+	binary.Write(b, binary.LittleEndian, uint32(len(s)))
+	b.WriteString(s + "\x00")
+}
+
+func pad(b *bytes.Buffer, n int) {
+	for b.Len()%n != 0 {
+		b.WriteByte(0)
+	}
+}
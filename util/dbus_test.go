@@ -0,0 +1,80 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSystemdUnits(t *testing.T) {
+	systemBusSocket = filepath.Join(t.TempDir(), "bus.sock")
+	l, err := net.Listen("unix", systemBusSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	calls := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fakeSystemBus(t, c, calls)
+		}
+	}()
+
+	if err := StartUnit("app.target"); err != nil {
+		t.Fatal(err)
+	} else if err := StopUnit("app.target"); err != nil {
+		t.Fatal(err)
+	} else if err := StartUnit("missing.target"); err == nil || !strings.Contains(err.Error(), "NoSuchUnit: unit missing.target not found") {
+		t.Fatalf("expected NoSuchUnit error got %v", err)
+	}
+	for _, expected := range []string{"Hello", "StartUnit app.target replace", "Hello", "StopUnit app.target replace", "Hello"} {
+		if call := <-calls; call != expected {
+			t.Fatalf("expected %q got %q", expected, call)
+		}
+	}
+}
+
+func fakeSystemBus(t *testing.T, c net.Conn, calls chan<- string) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if l, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(l, "\x00AUTH EXTERNAL ") {
+		t.Errorf("unexpected auth: %q %v", l, err)
+		return
+	} else if _, err := c.Write([]byte("OK 0123456789abcdef\r\n")); err != nil {
+		t.Error(err)
+		return
+	} else if l, err := r.ReadString('\n'); err != nil || l != "BEGIN\r\n" {
+		t.Errorf("unexpected begin: %q %v", l, err)
+		return
+	}
+	for serial := uint32(100); ; serial++ {
+		m, err := readDBusMessage(r)
+		if err != nil {
+			return
+		}
+		call, dr := m.member, &dbusReader{m.order, m.body, 0}
+		for range m.signature {
+			s, _ := readDBusString(dr)
+			call += " " + s
+		}
+		calls <- call
+		reply := &dbusMessage{kind: dbusMethodReturn, serial: serial, replySerial: m.serial}
+		if strings.Contains(call, "missing") {
+			body := &bytes.Buffer{}
+			writeDBusString(body, "unit missing.target not found")
+			reply.kind, reply.signature, reply.body = dbusError, "s", body.Bytes()
+			reply.errorName = "org.freedesktop.systemd1.NoSuchUnit"
+		}
+		c.Write(reply.marshal())
+		if m.member == "Hello" {
+			c.Write((&dbusMessage{kind: 4, serial: serial + 1000, member: "NameAcquired"}).marshal())
+		}
+	}
+}
@@ -25,18 +25,9 @@ func OpenVault(path string, createIfMissing bool) (Vault, error) {
 	} else if !createIfMissing {
 		return nil, err
 	}
-	log.Println("Please enter a password:")
-	pass, err := term.ReadPassword(int(syscall.Stdin))
+	pass, err := ReadPassword()
 	if err != nil {
 		return nil, err
-	} else if len(pass) == 0 {
-		return nil, fmt.Errorf("password must not be empty")
-	}
-	log.Println("Enter password again:")
-	if pass2, err := term.ReadPassword(int(syscall.Stdin)); err != nil {
-		return nil, err
-	} else if string(pass) != string(pass2) {
-		return nil, fmt.Errorf("passwords did not match")
 	}
 	/* https://en.wikipedia.org/wiki/Salt_(cryptography)#Salt_re-use
 	   To get a key that can be recreated with just the passphrase the salt must not
@@ -51,6 +42,23 @@ func OpenVault(path string, createIfMissing bool) (Vault, error) {
 	return k, os.WriteFile(path, k, 0600)
 }
 
+func ReadPassword() ([]byte, error) {
+	log.Println("Please enter a password:")
+	pass, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return nil, err
+	} else if len(pass) == 0 {
+		return nil, fmt.Errorf("password must not be empty")
+	}
+	log.Println("Enter password again:")
+	if pass2, err := term.ReadPassword(int(syscall.Stdin)); err != nil {
+		return nil, err
+	} else if string(pass) != string(pass2) {
+		return nil, fmt.Errorf("passwords did not match")
+	}
+	return pass, nil
+}
+
 func (v Vault) Encrypt(plaintext string) (string, error) {
 	k, nonce := [32]byte{}, [24]byte{}
 	copy(k[:], v)